@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// how often the rules file is checked for changes
+const alertReloadInterval = 5 * time.Second
+
+// Threshold rule evaluated against every received telemetry frame. A rule
+// with the "<" comparison raises a warning/error when the value drops below
+// the level, ">" when it rises above. Once raised the level is held until the
+// value has recovered past the threshold by Hysteresis, stopping the
+// dashboard from flickering when a value sits right on a limit.
+type AlertRule struct {
+	Field      string
+	Comparison string
+	Warning    float64
+	Error      float64
+	Hysteresis float64
+	// fields flagged on the dashboard, defaults to Field
+	StatusFields []string `json:",omitempty"`
+}
+
+// used when no rules file can be found
+var defaultAlertRules = []AlertRule{
+	// the fuel level is checked as well as the laps remaining, which are
+	// only known once a lap's fuel use has been measured
+	{Field: "FuelLevel", Comparison: "<", Warning: 20, Error: 5, StatusFields: []string{"FuelRemaining", "FuelLevel"}},
+	{Field: alertFuelLapsRemaining, Comparison: "<", Warning: 5, Error: 2, StatusFields: []string{"FuelRemaining", "FuelLevel"}},
+	{Field: "CoolantTemp", Comparison: ">", Warning: 105, Error: 110},
+	{Field: "BatteryVoltage", Comparison: "<", Warning: 12, Error: 11},
+	{Field: "OilTemp", Comparison: ">", Warning: 250, Error: 260},
+	{Field: alertStintMinutesRemaining, Comparison: "<", Warning: 15, Error: 0},
+}
+
+// values calculated by the server that rules can use as a Field
+var derivedAlertFields = map[string]bool{
+	alertFuelLapsRemaining:     true,
+	alertFuelMinutesRemaining:  true,
+	alertStintMinutesRemaining: true,
+}
+
+type alertLevel int
+
+const (
+	alertOK alertLevel = iota
+	alertWarning
+	alertError
+)
+
+type AlertEngine struct {
+	path    string
+	modTime time.Time
+
+	mu    sync.Mutex
+	rules []AlertRule
+	// incremented whenever the rules change
+	generation int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewAlertEngine loads the rules file at path, using defaults if there is
+// no such file
+func NewAlertEngine(path string, defaults []AlertRule) (*AlertEngine, error) {
+	engine := &AlertEngine{path: path}
+	if err := engine.Reload(); err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			return nil, err
+		}
+		log.Println("no alert rules file found, using defaults:", path)
+		engine.setRules(defaults)
+	}
+	return engine, nil
+}
+
+// reads the rules file, replacing the current rules only if every rule in
+// the file is valid
+func (e *AlertEngine) Reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat alert rules")
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open alert rules")
+	}
+	defer f.Close()
+
+	var rules []AlertRule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return errors.Wrapf(err, "unable to parse alert rules %s", e.path)
+	}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return errors.Wrapf(err, "invalid alert rule in %s", e.path)
+		}
+	}
+
+	e.modTime = info.ModTime()
+	e.setRules(rules)
+	log.Println("loaded", len(rules), "alert rules from", e.path)
+	return nil
+}
+
+func (e *AlertEngine) setRules(rules []AlertRule) {
+	e.mu.Lock()
+	e.rules = rules
+	e.generation++
+	e.mu.Unlock()
+}
+
+// Rules returns a copy of the rules currently in use
+func (e *AlertEngine) Rules() []AlertRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]AlertRule(nil), e.rules...)
+}
+
+// starts watching the rules file, reloading it whenever it is modified
+func (e *AlertEngine) Start() {
+	e.stop = make(chan struct{})
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(alertReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(e.path)
+				if err != nil || info.ModTime().Equal(e.modTime) {
+					continue
+				}
+				if err := e.Reload(); err != nil {
+					log.Println("keeping previous alert rules:", err)
+					// don't retry until the file changes again
+					e.modTime = info.ModTime()
+				}
+			}
+		}
+	}()
+}
+
+func (e *AlertEngine) Close() {
+	if e.stop != nil {
+		close(e.stop)
+		e.wg.Wait()
+		e.stop = nil
+	}
+}
+
+// The level each rule was last in for one car, used for hysteresis
+type AlertState struct {
+	generation int
+	levels     []alertLevel
+}
+
+// Evaluate checks the telemetry against every rule and returns the fields
+// that are in a warning or error state, each once at the highest level of
+// the rules flagging it. derived holds values calculated by the server, such
+// as predictions, that rules can use as well as telemetry fields. state
+// holds the levels from the previous call for the same car.
+func (e *AlertEngine) Evaluate(t *telemetry.Telemetry, derived map[string]float64, state *AlertState) (warnings []string, errs []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if state.generation != e.generation {
+		state.generation = e.generation
+		state.levels = make([]alertLevel, len(e.rules))
+	}
+
+	// fields in the order they were first flagged
+	var flagged []string
+	levels := make(map[string]alertLevel)
+	for i, rule := range e.rules {
+		value, ok := derived[rule.Field]
+		if !ok {
+			var err error
+			if value, err = telemetryFieldValue(t, rule.Field); err != nil {
+				continue
+			}
+		}
+		state.levels[i] = rule.level(value, state.levels[i])
+
+		fields := rule.StatusFields
+		if len(fields) == 0 {
+			fields = []string{rule.Field}
+		}
+		if state.levels[i] == alertOK {
+			continue
+		}
+		for _, field := range fields {
+			level, ok := levels[field]
+			if !ok {
+				flagged = append(flagged, field)
+			}
+			if state.levels[i] > level {
+				levels[field] = state.levels[i]
+			}
+		}
+	}
+
+	for _, field := range flagged {
+		if levels[field] == alertError {
+			errs = append(errs, field)
+		} else {
+			warnings = append(warnings, field)
+		}
+	}
+	return warnings, errs
+}
+
+func (rule AlertRule) validate() error {
+	if !derivedAlertFields[rule.Field] {
+		if _, err := telemetryFieldValue(&telemetry.Telemetry{}, rule.Field); err != nil {
+			return err
+		}
+	}
+	switch rule.Comparison {
+	case "<":
+		if rule.Error > rule.Warning {
+			return fmt.Errorf("%s error level must not be above warning level", rule.Field)
+		}
+	case ">":
+		if rule.Error < rule.Warning {
+			return fmt.Errorf("%s error level must not be below warning level", rule.Field)
+		}
+	default:
+		return fmt.Errorf("%s has unknown comparison %q", rule.Field, rule.Comparison)
+	}
+	if rule.Hysteresis < 0 {
+		return fmt.Errorf("%s hysteresis must not be negative", rule.Field)
+	}
+	return nil
+}
+
+// works out the new level for value given the level the rule was last in
+func (rule AlertRule) level(value float64, previous alertLevel) alertLevel {
+	// thresholds the value must cross to (re)enter each level. A level that
+	// is already active is relaxed by the hysteresis
+	errorLevel, warningLevel := rule.Error, rule.Warning
+	relax := rule.Hysteresis
+	if rule.Comparison == "<" {
+		relax = -relax
+	}
+	if previous >= alertError {
+		errorLevel -= relax
+	}
+	if previous >= alertWarning {
+		warningLevel -= relax
+	}
+
+	beyond := func(limit float64) bool {
+		if rule.Comparison == "<" {
+			return value < limit
+		}
+		return value > limit
+	}
+	if beyond(errorLevel) {
+		return alertError
+	} else if beyond(warningLevel) {
+		return alertWarning
+	}
+	return alertOK
+}
+
+// looks up a numeric Telemetry field by name
+func telemetryFieldValue(t *telemetry.Telemetry, name string) (float64, error) {
+	v := reflect.ValueOf(t).Elem().FieldByName(name)
+	if !v.IsValid() {
+		return 0, fmt.Errorf("unknown telemetry field %q", name)
+	}
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	}
+	return 0, fmt.Errorf("telemetry field %q is not numeric", name)
+}
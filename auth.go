@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// number of sequence numbers below the highest received from a car that
+// are remembered, so late datagrams are accepted once each
+const replayWindow = 64
+
+// UplinkAuth checks that frames come from our car. UDP datagrams must carry
+// an HMAC made with the shared key, see telemetry.Sign, over an envelope
+// with a sequence number and time so that a captured datagram can't be
+// replayed. Websocket uplinks must present the token either as an
+// "Authorization: Bearer" header or a token query parameter. Either check is
+// skipped if its secret isn't configured.
+type UplinkAuth struct {
+	key   []byte
+	token string
+
+	mu sync.Mutex
+	// signed datagrams accepted from each car id
+	replay map[string]*replayState
+
+	udpRejected       uint64
+	webSocketRejected uint64
+}
+
+// counts of rejected uplink frames and connections
+type UplinkAuthStats struct {
+	UDPRejected       uint64
+	WebSocketRejected uint64
+}
+
+func NewUplinkAuth(key string, token string) *UplinkAuth {
+	if key == "" {
+		log.Println("WARNING no uplink key configured, accepting unsigned udp telemetry from anyone")
+	}
+	if token == "" {
+		log.Println("WARNING no uplink token configured, accepting websocket telemetry from anyone")
+	}
+	return &UplinkAuth{
+		key:    []byte(key),
+		token:  token,
+		replay: make(map[string]*replayState),
+	}
+}
+
+// Authenticated reports whether frames from source are checked
+func (a *UplinkAuth) Authenticated(source string) bool {
+	switch source {
+	case SourceUDP:
+		return len(a.key) > 0
+	case SourceWebSocket:
+		return a.token != ""
+	}
+	return false
+}
+
+// VerifyDatagram returns the frame from a UDP datagram, or false if it
+// isn't correctly signed
+func (a *UplinkAuth) VerifyDatagram(datagram []byte) ([]byte, bool) {
+	if len(a.key) == 0 {
+		return datagram, true
+	}
+	frame, err := telemetry.Verify(datagram, a.key)
+	if err == nil {
+		err = a.checkReplay(frame, time.Now())
+	}
+	if err != nil {
+		a.reject(&a.udpRejected, "udp datagram", err.Error())
+		return nil, false
+	}
+	return frame, true
+}
+
+// the signed datagrams accepted from a car
+type replayState struct {
+	highest uint32
+	// bit i is set if highest-i has been accepted
+	seen uint64
+	// latest time sent by the car
+	lastTime time.Time
+	// time of the first datagram since the car started, anything sent
+	// before is from a previous run
+	started time.Time
+}
+
+// rejects a signed frame that has been received before or is too old to
+// tell. The envelope is covered by the signature so neither its sequence
+// nor its time can be changed.
+func (a *UplinkAuth) checkReplay(frame []byte, now time.Time) error {
+	env, _, err := telemetry.Unwrap(frame)
+	if err != nil {
+		return err
+	}
+	if env.Sequence == 0 || env.Time.IsZero() {
+		return fmt.Errorf("signed datagram has no sequence number and time")
+	}
+	skew := time.Duration(config.UplinkClockSkew)
+	if env.Time.Before(now.Add(-skew)) || env.Time.After(now.Add(skew)) {
+		return fmt.Errorf("datagram time %s is more than %s from ours", env.Time.Format(time.RFC3339), skew)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.replay[env.CarID]
+	var ahead int32
+	if ok {
+		// the difference is signed so the sequence can wrap
+		ahead = int32(env.Sequence - s.highest)
+	}
+	switch {
+	case !ok || (ahead <= -replayWindow && env.Time.After(s.lastTime)):
+		// the first datagram, or the car restarted, as it can only be sent
+		// after everything before it if it isn't a replay
+		s = &replayState{highest: env.Sequence, seen: 1, started: env.Time}
+		a.replay[env.CarID] = s
+	case env.Time.Before(s.started):
+		return fmt.Errorf("datagram sequence %d was sent before the car restarted", env.Sequence)
+	case ahead > 0:
+		if ahead >= replayWindow {
+			s.seen = 1
+		} else {
+			s.seen = s.seen<<uint(ahead) | 1
+		}
+		s.highest = env.Sequence
+	case ahead <= -replayWindow:
+		return fmt.Errorf("datagram sequence %d is too old", env.Sequence)
+	default:
+		bit := uint64(1) << uint(-ahead)
+		if s.seen&bit != 0 {
+			return fmt.Errorf("datagram sequence %d has already been received", env.Sequence)
+		}
+		s.seen |= bit
+	}
+	if env.Time.After(s.lastTime) {
+		s.lastTime = env.Time
+	}
+	return nil
+}
+
+// VerifyRequest checks the token on an incoming websocket upgrade
+func (a *UplinkAuth) VerifyRequest(req *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	token := req.URL.Query().Get("token")
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		a.reject(&a.webSocketRejected, "websocket uplink from "+req.RemoteAddr, "invalid token")
+		return false
+	}
+	return true
+}
+
+func (a *UplinkAuth) reject(counter *uint64, what string, reason string) {
+	count := atomic.AddUint64(counter, 1)
+	// don't flood the log if someone is hammering the uplink
+	if count == 1 || count%100 == 0 {
+		log.Println("rejected", what+":", reason, "- total rejected:", count)
+	}
+}
+
+func (a *UplinkAuth) Stats() UplinkAuthStats {
+	return UplinkAuthStats{
+		UDPRejected:       atomic.LoadUint64(&a.udpRejected),
+		WebSocketRejected: atomic.LoadUint64(&a.webSocketRejected),
+	}
+}
+
+// HTTP request handler for the rejected uplink counts
+func UplinkAuthStatsHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(uplinkAuth.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
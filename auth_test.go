@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"testing"
+	"time"
+)
+
+type replayFrame struct {
+	car      string
+	sequence uint32
+	// the car's clock, from ours
+	offset time.Duration
+	ok     bool
+}
+
+func TestCheckReplay(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	skew := time.Duration(config.UplinkClockSkew)
+
+	tests := []struct {
+		name   string
+		frames []replayFrame
+	}{
+		{
+			name: "in order, duplicate and out of order",
+			frames: []replayFrame{
+				{"", 10, 0, true},
+				{"", 11, 0, true},
+				{"", 11, 0, false},
+				{"", 13, 0, true},
+				{"", 12, 0, true},
+				{"", 12, 0, false},
+				{"", 10, 0, false},
+			},
+		},
+		{
+			name: "older than the window",
+			frames: []replayFrame{
+				{"", 100, 0, true},
+				{"", 100 - replayWindow + 1, 0, true},
+				{"", 100 - replayWindow, 0, false},
+				{"", 1, 0, false},
+			},
+		},
+		{
+			name: "car restarts",
+			frames: []replayFrame{
+				{"", 5000, 0, true},
+				{"", 1, time.Second, true},
+				{"", 2, 2 * time.Second, true},
+				// sent before the restart
+				{"", 4999, 0, false},
+				{"", 5001, 0, false},
+				{"", 1, 2 * time.Second, false},
+			},
+		},
+		{
+			name: "clock skew",
+			frames: []replayFrame{
+				{"", 1, -skew - time.Second, false},
+				{"", 2, skew + time.Second, false},
+				{"", 3, -skew + time.Second, true},
+				{"", 4, skew - time.Second, true},
+			},
+		},
+		{
+			name: "windows per car",
+			frames: []replayFrame{
+				{"car1", 10, 0, true},
+				{"car2", 10, 0, true},
+				{"car1", 10, 0, false},
+				{"car2", 500, 0, true},
+				{"car1", 11, 0, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &UplinkAuth{replay: make(map[string]*replayState)}
+			for i, f := range test.frames {
+				env := telemetry.Envelope{CarID: f.car, Sequence: f.sequence, Time: now.Add(f.offset)}
+				frame, err := telemetry.Wrap(env, []byte{telemetry.TypeMarker})
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = a.checkReplay(frame, now)
+				if ok := err == nil; ok != f.ok {
+					t.Errorf("frame %d, car %q sequence %d: accepted %v, want %v (%v)", i, f.car, f.sequence, ok, f.ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckReplayNeedsSequenceAndTime(t *testing.T) {
+	now := time.Now()
+	a := &UplinkAuth{replay: make(map[string]*replayState)}
+	for _, env := range []telemetry.Envelope{
+		{Time: now},
+		{Sequence: 1},
+	} {
+		frame, err := telemetry.Wrap(env, []byte{telemetry.TypeMarker})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.checkReplay(frame, now); err == nil {
+			t.Errorf("accepted %+v", env)
+		}
+	}
+}
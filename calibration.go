@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Calibrates the video delay. The pit crew triggers a marker, either from
+// the calibration page or with a marker frame from the car, and the server
+// notes when it arrived. When the same moment shows up on the video stream
+// the operator marks it as seen and the time between the two becomes the
+// new default video delay.
+type VideoCalibration struct {
+	mu sync.Mutex
+
+	// when the pending marker arrived, zero if there isn't one
+	marker    time.Time
+	markerCar string
+
+	// result of the last calibration
+	calibrated time.Time
+	delay      time.Duration
+}
+
+// CalibrationStatus is returned by the calibration HTTP handlers
+type CalibrationStatus struct {
+	// the marker waiting to be seen on the video stream
+	Marker    *time.Time `json:",omitempty"`
+	MarkerCar string     `json:",omitempty"`
+	// seconds since the marker arrived
+	Elapsed float64 `json:",omitempty"`
+
+	Calibrated *time.Time `json:",omitempty"`
+	// the delay in seconds worked out by the last calibration
+	CalibratedDelay float64 `json:",omitempty"`
+	// the default video delay in seconds
+	Delay float64
+}
+
+var calibration = &VideoCalibration{}
+
+// Mark starts a calibration, replacing any marker that hasn't been seen
+func (c *VideoCalibration) Mark(car string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.marker = time.Now()
+	c.markerCar = car
+	log.Println("video delay calibration marker from", car)
+}
+
+// Seen finishes a calibration, setting the default video delay to the
+// time since the marker arrived
+func (c *VideoCalibration) Seen() (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.marker.IsZero() {
+		return 0, fmt.Errorf("no calibration marker has been sent")
+	}
+
+	elapsed := time.Since(c.marker)
+	delay, err := videoDelaySeconds(elapsed.Seconds())
+	c.marker = time.Time{}
+	if err != nil {
+		return 0, fmt.Errorf("marker was seen after %v: %v", elapsed, err)
+	}
+
+	c.calibrated = time.Now()
+	c.delay = delay
+	videoDelay.Set(delay)
+	log.Println("video delay calibrated to", delay)
+	return delay, nil
+}
+
+// Cancel discards a marker that won't be seen on the stream
+func (c *VideoCalibration) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.marker = time.Time{}
+}
+
+func (c *VideoCalibration) Status() CalibrationStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := CalibrationStatus{Delay: videoDelay.Get().Seconds()}
+	if !c.marker.IsZero() {
+		marker := c.marker
+		status.Marker = &marker
+		status.MarkerCar = c.markerCar
+		status.Elapsed = time.Since(marker).Seconds()
+	}
+	if !c.calibrated.IsZero() {
+		calibrated := c.calibrated
+		status.Calibrated = &calibrated
+		status.CalibratedDelay = c.delay.Seconds()
+	}
+	return status
+}
+
+// RegisterHandlers adds the calibration API to the router:
+//
+//	GET  /videosync/calibrate          status of the calibration
+//	POST /videosync/calibrate/marker   the marker moment has happened
+//	POST /videosync/calibrate/seen     the marker moment is on the stream
+//	POST /videosync/calibrate/cancel   discard the marker
+//
+// Every request responds with the calibration status.
+func (c *VideoCalibration) RegisterHandlers(router *mux.Router) {
+	router.HandleFunc("/videosync/calibrate", c.calibrationHandler(func(req *http.Request) error {
+		return nil
+	})).Methods("GET")
+	router.HandleFunc("/videosync/calibrate/marker", c.calibrationHandler(func(req *http.Request) error {
+		car := req.FormValue("car")
+		if car == "" {
+			car = defaultCarID
+		}
+		c.Mark(car)
+		return nil
+	})).Methods("POST")
+	router.HandleFunc("/videosync/calibrate/seen", c.calibrationHandler(func(req *http.Request) error {
+		_, err := c.Seen()
+		return err
+	})).Methods("POST")
+	router.HandleFunc("/videosync/calibrate/cancel", c.calibrationHandler(func(req *http.Request) error {
+		c.Cancel()
+		return nil
+	})).Methods("POST")
+}
+
+// runs a calibration request and replies with the status
+func (c *VideoCalibration) calibrationHandler(action func(req *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := action(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := json.Marshal(c.Status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
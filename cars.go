@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"log"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// car that frames without a car id in their envelope belong to
+const defaultCarID = "default"
+
+// stops a misbehaving uplink from creating unbounded state
+const maxCars = 16
+
+var validCarID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ids that would make a car's endpoints ambiguous with the default car's,
+// e.g. /ws/telemetry_out/videosync
+var reservedCarIDs = map[string]bool{
+	"videosync": true,
+}
+
+// checks id can be used for a car
+func checkCarID(id string) error {
+	if !validCarID.MatchString(id) {
+		return fmt.Errorf("invalid car id %q", id)
+	}
+	if reservedCarIDs[id] {
+		return fmt.Errorf("car id %q is reserved", id)
+	}
+	return nil
+}
+
+// Car holds the live state and broadcasters for one car. Each car is
+// served on its own /ws/telemetry_out/{car} endpoints.
+type Car struct {
+	ID string
+
+	// used to control access to lastTelemetry and lastTiming
+	lock sync.RWMutex
+
+	// contains the last received telemetry values so that it
+	// can be sent to newly connecting clients between receives
+	// of telemetry and any HTTP requests
+	lastTelemetry telemetry.TelemetryWithStatus
+	lastTiming    telemetry.Timing
+	// false until timing is received or timed from GPS
+	haveTiming bool
+	// zero until telemetry is received
+	lastTelemetryTime time.Time
+	// when timing was last received from the car or a timing feed
+	lastExternalTiming time.Time
+
+	// reconstructs full telemetry from the delta frames sent by the car
+	decoder    *telemetry.Decoder
+	alertState AlertState
+	// finds laps from GPS, nil without a start/finish line
+	laps *LapDetector
+	// finds pit stops from GPS, nil without a pit lane
+	pits   *PitDetector
+	fuel   *FuelModel
+	stints *StintTracker
+
+	// broadcasts uplinked telemetry to clients as it arrives
+	hub *Hub
+	// health of the uplink, sent to clients of the hub
+	link *LinkMonitor
+	// removes the copies of frames sent over more than one source
+	merger *FrameMerger
+
+	// recent telemetry, played back to each videosync client once it has
+	// been delayed to match the video stream
+	videoSync *SyncedHistory
+}
+
+var cars = struct {
+	sync.RWMutex
+	byID map[string]*Car
+}{byID: make(map[string]*Car)}
+
+// GetCar returns the car with the given id, creating it the first time a
+// frame is received from it
+func GetCar(id string) (*Car, error) {
+	if id == "" {
+		id = defaultCarID
+	}
+
+	cars.RLock()
+	car, ok := cars.byID[id]
+	cars.RUnlock()
+	if ok {
+		return car, nil
+	}
+
+	if err := checkCarID(id); err != nil {
+		return nil, err
+	}
+
+	cars.Lock()
+	defer cars.Unlock()
+	if car, ok := cars.byID[id]; ok {
+		return car, nil
+	}
+	if len(cars.byID) >= maxCars {
+		return nil, fmt.Errorf("too many cars, ignoring car %q", id)
+	}
+	car = newCar(id)
+	cars.byID[id] = car
+	log.Println("added car", id)
+	return car, nil
+}
+
+// UplinkCar returns the car a frame received from source belongs to. New
+// cars are only added if they are listed in the config or the frame was
+// authenticated, otherwise anyone could use up every car.
+func UplinkCar(id string, source string) (*Car, error) {
+	if id == "" {
+		id = defaultCarID
+	}
+	if car, ok := LookupCar(id); ok {
+		return car, nil
+	}
+	if !uplinkAuth.Authenticated(source) {
+		return nil, fmt.Errorf("unknown car %q, it must be listed in Cars in the config when the %s uplink isn't authenticated", id, source)
+	}
+	return GetCar(id)
+}
+
+// LookupCar returns an existing car
+func LookupCar(id string) (*Car, bool) {
+	cars.RLock()
+	defer cars.RUnlock()
+	car, ok := cars.byID[id]
+	return car, ok
+}
+
+// CarIDs returns the ids of every car, sorted
+func CarIDs() []string {
+	cars.RLock()
+	defer cars.RUnlock()
+	ids := make([]string, 0, len(cars.byID))
+	for id := range cars.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newCar(id string) *Car {
+	car := &Car{
+		ID: id,
+		lastTelemetry: telemetry.TelemetryWithStatus{
+			Telemetry: &telemetry.Telemetry{
+				Latitude:       35.488151852742455,
+				Longitude:      -119.53969199955463,
+				RPM:            4321,
+				Speed:          90,
+				CoolantTemp:    60,
+				OilTemp:        104,
+				BatteryVoltage: 11.3,
+				FuelRemaining:  90,
+			},
+			WarningFields: []string{""},
+			ErrorFields:   []string{""},
+		},
+		decoder: telemetry.NewDecoder(),
+		fuel:    NewFuelModel(),
+		stints:  NewStintTracker(),
+
+		hub:       NewHub("car " + id),
+		link:      NewLinkMonitor(),
+		videoSync: NewSyncedHistory(),
+	}
+	car.merger = NewFrameMerger(car.processFrame, car.link.Used)
+	if currentTrack != nil && currentTrack.StartFinish != (GPSLine{}) {
+		car.laps = NewLapDetector(*currentTrack)
+	}
+	if currentTrack != nil && len(currentTrack.PitLane) > 0 {
+		car.pits = NewPitDetector(currentTrack.PitLane)
+	}
+	car.hub.Start()
+	// replayed frames don't arrive over the uplink
+	if !replaying {
+		car.link.Start(car)
+	}
+	return car
+}
+
+// RestoreSession rebuilds the cars' fuel consumption and stints from the
+// session that is being carried on, so restarting the server mid-race
+// doesn't lose them
+func RestoreSession(dir string) error {
+	session, ok, err := CurrentSession(dir, time.Now())
+	if err != nil || !ok {
+		return err
+	}
+
+	restored := 0
+	err = ScanSession(session.Path, func(rec Record) error {
+		car, err := GetCar(rec.Car)
+		if err != nil {
+			return nil
+		}
+		car.restore(rec)
+		restored++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("restored", restored, "records from session", session.ID)
+	return nil
+}
+
+// updates the car's models with a recorded frame without publishing it
+func (car *Car) restore(rec Record) {
+	switch {
+	case rec.Telemetry != nil:
+		car.fuel.Add(float64(rec.Telemetry.FuelRemaining), rec.Time)
+	case rec.Timing != nil:
+		timing := *rec.Timing
+		fuelUsed, _ := car.fuel.Lap(timing.LapCount)
+		car.stints.Timing(&timing, fuelUsed)
+	case rec.DriverChange != nil:
+		if err := car.stints.ChangeDriver(rec.DriverChange.Driver, rec.Time); err != nil {
+			log.Println("skipping recorded driver change:", err)
+		}
+	}
+}
+
+// Close disconnects every client of the car
+func (car *Car) Close() {
+	car.merger.Close()
+	car.link.Close()
+	car.hub.Close()
+	car.videoSync.Close()
+}
+
+// CloseCars disconnects the clients of every car, for shutting down
+func CloseCars() {
+	cars.Lock()
+	defer cars.Unlock()
+	for _, car := range cars.byID {
+		car.Close()
+	}
+}
+
+// Publish adds status to a decoded telemetry.Telemetry or telemetry.Timing
+// and forwards it to the car's broadcasters
+func (car *Car) Publish(telemetryMsg interface{}) error {
+	if _, ok := telemetryMsg.(telemetry.Timing); ok {
+		car.lock.Lock()
+		car.lastExternalTiming = time.Now()
+		car.lock.Unlock()
+	}
+	return car.publish(telemetryMsg)
+}
+
+// converts telemetry as recorded to the units sent to dashboards, speed is
+// received in km/h and shown in mph
+func liveUnits(t telemetry.Telemetry) telemetry.Telemetry {
+	t.Speed = float32(int(t.Speed*0.6213712*10)) / 10
+	return t
+}
+
+func (car *Car) publish(telemetryMsg interface{}) error {
+	var err error
+	var lap *Lap
+	var sector *telemetry.SectorTiming
+	var fuel *telemetry.FuelPrediction
+	var pit *telemetry.PitStop
+	var b []byte
+	now := time.Now()
+
+	switch msg := telemetryMsg.(type) {
+	case telemetry.Telemetry:
+		msg = liveUnits(msg)
+
+		car.fuel.Add(float64(msg.FuelRemaining), now)
+		prediction, derived := car.fuel.Predict()
+		if remaining, ok := car.stints.minutesRemaining(stintRules, now); ok {
+			derived[alertStintMinutesRemaining] = remaining
+		}
+		if car.fuel.due(now) {
+			fuel = &prediction
+		}
+
+		// add error/warning fields
+		warnings, errs := alerts.Evaluate(&msg, derived, &car.alertState)
+
+		telemetryWithStatus := telemetry.TelemetryWithStatus{
+			Telemetry:     &msg,
+			WarningFields: warnings,
+			ErrorFields:   errs,
+		}
+
+		car.lock.Lock()
+		car.lastTelemetry = telemetryWithStatus
+		car.lastTelemetryTime = now
+		car.lock.Unlock()
+
+		b, err = telemetryWithStatus.JSONEncode()
+		if err != nil {
+			return errors.Wrap(err, "cannot json encode telemetry")
+		}
+
+		if car.laps != nil {
+			lap, sector = car.laps.Update(msg, now)
+		}
+		if car.pits != nil {
+			car.lock.RLock()
+			lapCount := car.lastTiming.LapCount
+			car.lock.RUnlock()
+			pit = car.pits.Update(msg, lapCount, now)
+		}
+	case telemetry.Timing:
+		fuelUsed, _ := car.fuel.Lap(msg.LapCount)
+		car.stints.Timing(&msg, fuelUsed)
+
+		car.lock.Lock()
+		car.lastTiming = msg
+		car.haveTiming = true
+		car.lock.Unlock()
+
+		b, err = msg.JSONEncode()
+		if err != nil {
+			return errors.Wrap(err, "cannot JSON encode timing")
+		}
+	default:
+		return fmt.Errorf("unknown message %T", telemetryMsg)
+	}
+
+	car.hub.Send(b)
+	car.videoSync.Add(now, b)
+
+	if sector != nil {
+		b, err = sector.JSONEncode()
+		if err != nil {
+			return errors.Wrap(err, "cannot JSON encode sector")
+		}
+		car.hub.Send(b)
+		car.videoSync.Add(now, b)
+	}
+	if pit != nil {
+		if pit.Exit != nil {
+			car.recordPitStop(*pit)
+		}
+		b, err = pit.JSONEncode()
+		if err != nil {
+			return errors.Wrap(err, "cannot JSON encode pit stop")
+		}
+		car.hub.Send(b)
+		car.videoSync.Add(now, b)
+	}
+	if fuel != nil {
+		b, err = fuel.JSONEncode()
+		if err != nil {
+			return errors.Wrap(err, "cannot JSON encode fuel prediction")
+		}
+		car.hub.Send(b)
+		car.videoSync.Add(now, b)
+	}
+	if lap != nil {
+		return car.publishLap(lap)
+	}
+	return nil
+}
+
+// LastMessages returns the JSON encoded last telemetry and timing, sent to
+// newly connecting clients. timingMsg is nil until timing is received.
+func (car *Car) LastMessages() (telemetryMsg []byte, timingMsg []byte, err error) {
+	car.lock.RLock()
+	defer car.lock.RUnlock()
+	telemetryMsg, err = car.lastTelemetry.JSONEncode()
+	if err != nil || !car.haveTiming {
+		return telemetryMsg, nil, err
+	}
+	timingMsg, err = car.lastTiming.JSONEncode()
+	return telemetryMsg, timingMsg, err
+}
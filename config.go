@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// read from the working directory if it exists and no other file is given
+const defaultConfigFile = "lemonaid.json"
+
+// Config holds the server's settings. Each is read from the config file,
+// then overridden by its environment variable and then by its flag, see
+// configSettings.
+type Config struct {
+	HTTPAddr string
+	UDPAddr  string
+
+	// cars other than the default car that frames are accepted from. Cars
+	// not listed are only added when their uplink is authenticated.
+	Cars []string `json:",omitempty"`
+	// secrets the car's uplink is checked with, see UplinkAuth. They are
+	// best kept in the config file or environment, flags show up in ps.
+	UplinkKey   string `json:",omitempty"`
+	UplinkToken string `json:",omitempty"`
+
+	// the race timing feed, and our race number in it
+	TimingAddr     string `json:",omitempty"`
+	TimingProtocol string
+	CarNumber      string `json:",omitempty"`
+
+	// laps, sectors and pit stops are detected from GPS on Track, from
+	// TracksFile. StartFinish, "lat,lon,lat,lon", and PitLane,
+	// "lat,lon;lat,lon;...", override its lines or are used without one.
+	Track       string `json:",omitempty"`
+	StartFinish string `json:",omitempty"`
+	PitLane     string `json:",omitempty"`
+
+	// HTTPS is served on HTTPSAddr when both a certificate and key are
+	// given, they are reloaded when the files change
+	HTTPSAddr   string
+	TLSCertFile string
+	TLSKeyFile  string
+	// redirect pages served over HTTP to HTTPS. The car's uplink is
+	// refused over HTTP unless HTTPUplink is set, for cars that can't use
+	// TLS, as its token would be sent in cleartext.
+	RedirectHTTP bool
+	HTTPUplink   bool
+
+	TemplateDir string
+	StaticDir   string
+	SessionDir  string
+
+	// alert thresholds are kept in their own file rather than here so that
+	// they can be changed during a race, the built in rules are used if it
+	// doesn't exist
+	AlertRulesFile string
+	TracksFile     string
+	StintRulesFile string
+
+	// default delay of videosync clients
+	VideoDelay   configDuration
+	StaleTimeout configDuration
+	// how far the time on a signed datagram may be from ours before it is
+	// rejected as a replay, the car's clock is set from GPS
+	UplinkClockSkew configDuration
+
+	// messages queued for each car's broadcaster, for each client and for
+	// the session recorder
+	HubBufferSize        int
+	SubscriberBufferSize int
+	RecorderBufferSize   int
+}
+
+// the server's settings, set by main before anything else starts
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		HTTPAddr: ":80",
+		UDPAddr:  ":2020",
+
+		HTTPSAddr: ":443",
+
+		TimingProtocol: "rmonitor",
+
+		TemplateDir: "templates",
+		StaticDir:   "static",
+		SessionDir:  "sessions",
+
+		AlertRulesFile: "alerts.json",
+		TracksFile:     "tracks.json",
+		StintRulesFile: "stints.json",
+
+		VideoDelay:   configDuration(63 * time.Second),
+		StaleTimeout: configDuration(5 * time.Second),
+
+		UplinkClockSkew: configDuration(30 * time.Second),
+
+		HubBufferSize:        3,
+		SubscriberBufferSize: 3,
+		RecorderBufferSize:   1000,
+	}
+}
+
+// a duration written as a string in the config file, e.g. "1m3s"
+type configDuration time.Duration
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1m3s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+// a setting that can be given by flag or environment variable
+type configSetting struct {
+	// the flag name, the environment variable is the name in upper case
+	// with a LEMONAID_ prefix, e.g. LEMONAID_HTTP_ADDR
+	name  string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var configSettings = []configSetting{
+	{"http-addr", "address to serve HTTP on", func(c *Config) interface{} { return &c.HTTPAddr }},
+	{"https-addr", "address to serve HTTPS on when a certificate is given", func(c *Config) interface{} { return &c.HTTPSAddr }},
+	{"tls-cert", "TLS certificate file, reloaded when changed", func(c *Config) interface{} { return &c.TLSCertFile }},
+	{"tls-key", "TLS private key file, reloaded when changed", func(c *Config) interface{} { return &c.TLSKeyFile }},
+	{"redirect-http", "redirect HTTP requests to HTTPS", func(c *Config) interface{} { return &c.RedirectHTTP }},
+	{"http-uplink", "accept the car's uplink over HTTP when redirecting to HTTPS, its token is sent in cleartext", func(c *Config) interface{} { return &c.HTTPUplink }},
+	{"udp-addr", "address to receive udp telemetry on", func(c *Config) interface{} { return &c.UDPAddr }},
+	{"uplink-key", "shared key used to sign udp telemetry", func(c *Config) interface{} { return &c.UplinkKey }},
+	{"uplink-token", "token required to send telemetry over websocket", func(c *Config) interface{} { return &c.UplinkToken }},
+	{"timing", "address of the race timing feed, e.g. timing.local:50000", func(c *Config) interface{} { return &c.TimingAddr }},
+	{"timing-protocol", "protocol spoken by the race timing feed", func(c *Config) interface{} { return &c.TimingProtocol }},
+	{"car", "our race number in the timing feed", func(c *Config) interface{} { return &c.CarNumber }},
+	{"track", "track from the track database to time laps and sectors on from GPS", func(c *Config) interface{} { return &c.Track }},
+	{"start-finish", "start/finish line to detect laps from GPS, lat,lon,lat,lon from the left to the right side of the track in the race direction", func(c *Config) interface{} { return &c.StartFinish }},
+	{"pit-lane", "pit lane to detect pit stops in, lat,lon;lat,lon;... around its edge", func(c *Config) interface{} { return &c.PitLane }},
+	{"templates", "directory of page templates", func(c *Config) interface{} { return &c.TemplateDir }},
+	{"static", "directory of static files", func(c *Config) interface{} { return &c.StaticDir }},
+	{"sessions", "directory session logs are recorded to", func(c *Config) interface{} { return &c.SessionDir }},
+	{"alert-rules", "alert rules file, reloaded when changed", func(c *Config) interface{} { return &c.AlertRulesFile }},
+	{"tracks", "track database", func(c *Config) interface{} { return &c.TracksFile }},
+	{"stint-rules", "driving time limits file", func(c *Config) interface{} { return &c.StintRulesFile }},
+	{"video-delay", "default delay of the videosync stream", func(c *Config) interface{} { return &c.VideoDelay }},
+	{"stale-timeout", "time without frames from a car before its telemetry is marked stale", func(c *Config) interface{} { return &c.StaleTimeout }},
+	{"uplink-clock-skew", "how far the time on a signed udp datagram may be from ours", func(c *Config) interface{} { return &c.UplinkClockSkew }},
+	{"hub-buffer", "messages queued for each car's broadcaster", func(c *Config) interface{} { return &c.HubBufferSize }},
+	{"subscriber-buffer", "messages queued for each dashboard", func(c *Config) interface{} { return &c.SubscriberBufferSize }},
+	{"recorder-buffer", "frames queued for the session recorder", func(c *Config) interface{} { return &c.RecorderBufferSize }},
+}
+
+func (s configSetting) env() string {
+	return "LEMONAID_" + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+func (s configSetting) set(c *Config, value string) error {
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a whole number", s.name)
+		}
+		*field = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", s.name)
+		}
+		*field = b
+	case *configDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as 1m3s", s.name)
+		}
+		*field = configDuration(d)
+	}
+	return nil
+}
+
+func (s configSetting) get(c *Config) string {
+	switch field := s.field(c).(type) {
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *bool:
+		return strconv.FormatBool(*field)
+	case *configDuration:
+		return time.Duration(*field).String()
+	}
+	return ""
+}
+
+// ConfigFlags registers a flag for each setting, returning the values to be
+// passed to LoadConfig once the flags have been parsed
+func ConfigFlags() map[string]*string {
+	defaults := defaultConfig()
+	values := make(map[string]*string)
+	for _, s := range configSettings {
+		value := s.get(&defaults)
+		_, isBool := s.field(&defaults).(*bool)
+		flag.Var(configFlag{&value, isBool}, s.name, s.usage+", or $"+s.env())
+		values[s.name] = &value
+	}
+	return values
+}
+
+// a setting's flag, kept as a string until the config is loaded. Flags for
+// true/false settings can be given without a value, e.g. -redirect-http.
+type configFlag struct {
+	value  *string
+	isBool bool
+}
+
+func (f configFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f configFlag) Set(value string) error {
+	*f.value = value
+	return nil
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// LoadConfig reads the config file, if path is empty the default file is
+// read if there is one, and applies the environment variables and the flags
+// that were given
+func LoadConfig(path string, flags map[string]*string) (Config, error) {
+	c := defaultConfig()
+
+	required := path != ""
+	if !required {
+		path = defaultConfigFile
+	}
+	f, err := os.Open(path)
+	if err == nil {
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&c)
+		f.Close()
+		if err != nil {
+			return c, errors.Wrapf(err, "unable to parse config file %s", path)
+		}
+	} else if required || !os.IsNotExist(err) {
+		return c, errors.Wrapf(err, "unable to open config file")
+	}
+
+	for _, s := range configSettings {
+		if value := os.Getenv(s.env()); value != "" {
+			if err := s.set(&c, value); err != nil {
+				return c, errors.Wrapf(err, "invalid $%s", s.env())
+			}
+		}
+	}
+	var flagErr error
+	flag.Visit(func(f *flag.Flag) {
+		for _, s := range configSettings {
+			if s.name == f.Name && flagErr == nil {
+				flagErr = s.set(&c, *flags[s.name])
+			}
+		}
+	})
+	if flagErr != nil {
+		return c, flagErr
+	}
+	return c, c.validate()
+}
+
+// TLS reports whether HTTPS is to be served
+func (c Config) TLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+func (c Config) validate() error {
+	if len(c.Cars) >= maxCars {
+		return fmt.Errorf("at most %d cars can be listed besides the default car", maxCars-1)
+	}
+	for _, id := range c.Cars {
+		if err := checkCarID(id); err != nil {
+			return err
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("a TLS certificate and key must be given together")
+	}
+	if c.TLS() && c.HTTPSAddr == "" {
+		return fmt.Errorf("an HTTPS address is needed to serve TLS")
+	}
+	if c.StartFinish != "" {
+		if _, err := ParseGPSLine(c.StartFinish); err != nil {
+			return errors.Wrap(err, "invalid start/finish line")
+		}
+	}
+	if c.PitLane != "" {
+		if _, err := ParseGPSPolygon(c.PitLane); err != nil {
+			return errors.Wrap(err, "invalid pit lane")
+		}
+	}
+	if c.RedirectHTTP && !c.TLS() {
+		return fmt.Errorf("HTTP can only be redirected when HTTPS is served")
+	}
+	if c.HTTPAddr == "" && !c.TLS() {
+		return fmt.Errorf("an HTTP address is needed when HTTPS isn't served")
+	}
+	if c.VideoDelay < 0 || time.Duration(c.VideoDelay) > maxVideoDelay {
+		return fmt.Errorf("video delay must be between 0 and %s", maxVideoDelay)
+	}
+	if c.StaleTimeout <= 0 {
+		return fmt.Errorf("stale timeout must be positive")
+	}
+	if c.UplinkClockSkew <= 0 {
+		return fmt.Errorf("uplink clock skew must be positive")
+	}
+	if c.HubBufferSize < 1 || c.SubscriberBufferSize < 1 || c.RecorderBufferSize < 1 {
+		return fmt.Errorf("buffer sizes must be at least 1")
+	}
+	return nil
+}
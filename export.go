@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// export file formats
+const (
+	ExportCSV     = "csv"
+	ExportParquet = "parquet"
+	// CSV laid out for import into MoTeC i2
+	ExportMoTeC = "motec"
+)
+
+// samples per second when no rate is given
+const defaultExportRate = 10
+
+// most rows in an export, enough for a 24 hour race at the default rate.
+// Stops a typo in the rate filling the disk, rows are written as they are
+// built so this doesn't bound memory use.
+const maxExportRows = 1000 * 1000
+
+// units that recorded values are in, channels can be converted to any of
+// the units in unitConversions
+var fieldUnits = map[string]string{
+	"RPM":            "rpm",
+	"Speed":          "km/h",
+	"GPSSpeed":       "km/h",
+	"OilTemp":        "C",
+	"CoolantTemp":    "C",
+	"AirIntakeTemp":  "C",
+	"BatteryVoltage": "V",
+	"Latitude":       "deg",
+	"Longitude":      "deg",
+	"Track":          "deg",
+	"Altitude":       "m",
+
+	"BestLap":          "s",
+	"LastLap":          "s",
+	"TeamAheadLastLap": "s",
+	"TeamAheadSplit":   "s",
+}
+
+var unitConversions = map[string]map[string]func(float64) float64{
+	"km/h": {
+		"mph": func(v float64) float64 { return v * 0.6213712 },
+		"m/s": func(v float64) float64 { return v / 3.6 },
+	},
+	"C": {
+		"F": func(v float64) float64 { return v*1.8 + 32 },
+	},
+	"m": {
+		"ft": func(v float64) float64 { return v * 3.28084 },
+	},
+	"s": {
+		"ms": func(v float64) float64 { return v * 1000 },
+	},
+}
+
+// ExportChannel is a Telemetry or Timing field written to an export
+type ExportChannel struct {
+	Name string
+	Unit string
+
+	timing  bool
+	convert func(float64) float64
+}
+
+// ExportOptions controls what is written by ExportSession
+type ExportOptions struct {
+	Format   string
+	Car      string
+	Channels []ExportChannel
+	// samples per second of the common time base
+	Rate float64
+}
+
+// ParseExportChannels parses a comma separated list of fields, each
+// optionally followed by the unit to convert it to, e.g. "RPM,Speed:mph".
+// An empty list is every numeric field.
+func ParseExportChannels(spec string) ([]ExportChannel, error) {
+	var names []string
+	if spec == "" {
+		names = append(telemetryFieldNames(), timingFieldNames()...)
+	} else {
+		names = strings.Split(spec, ",")
+	}
+
+	channels := make([]ExportChannel, 0, len(names))
+	for _, name := range names {
+		var unit string
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, unit = name[:i], name[i+1:]
+		}
+
+		channel := ExportChannel{Name: name, Unit: fieldUnits[name]}
+		if _, err := telemetryFieldValue(&telemetry.Telemetry{}, name); err != nil {
+			if _, err := timingFieldValue(&telemetry.Timing{}, name); err != nil {
+				return nil, fmt.Errorf("unknown channel %q", name)
+			}
+			channel.timing = true
+		}
+
+		if unit != "" && unit != channel.Unit {
+			convert, ok := unitConversions[channel.Unit][unit]
+			if !ok {
+				return nil, fmt.Errorf("cannot convert %s from %q to %q", name, channel.Unit, unit)
+			}
+			channel.Unit = unit
+			channel.convert = convert
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// every numeric Timing field
+func timingFieldNames() []string {
+	var names []string
+	typ := reflect.TypeOf(telemetry.Timing{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if _, err := timingFieldValue(&telemetry.Timing{}, name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// looks up a numeric Timing field by name, durations are in seconds
+func timingFieldValue(t *telemetry.Timing, name string) (float64, error) {
+	v := reflect.ValueOf(t).Elem().FieldByName(name)
+	if !v.IsValid() {
+		return 0, fmt.Errorf("unknown timing field %q", name)
+	}
+	if d, ok := v.Interface().(telemetry.JSONDuration); ok {
+		return time.Duration(d).Seconds(), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	}
+	return 0, fmt.Errorf("timing field %q is not numeric", name)
+}
+
+// A session resampled on to a common time base. Each row holds the latest
+// value of every channel at Start plus row/Rate seconds, NaN before a
+// channel has been received. Rows are built from the session log as they
+// are written rather than held in memory.
+type exportTable struct {
+	Start    time.Time
+	Rate     float64
+	Channels []ExportChannel
+	Rows     int
+	// seconds from Start that each lap was completed
+	Laps []float64
+
+	car  string
+	scan func(fn func(rec Record) error) error
+}
+
+func (t *exportTable) Time(row int) float64 {
+	return float64(row) / t.Rate
+}
+
+// whether a record is for the exported car and has values for it
+func (t *exportTable) selected(rec Record) bool {
+	car := rec.Car
+	if car == "" {
+		car = defaultCarID
+	}
+	return car == t.car && (rec.Telemetry != nil || rec.Timing != nil)
+}
+
+// reads the session log once to find how many rows there will be and where
+// the laps are, so a too high rate is rejected before anything is written
+func buildExportTable(scan func(fn func(rec Record) error) error, opts ExportOptions) (*exportTable, error) {
+	table := &exportTable{Rate: opts.Rate, Channels: opts.Channels, car: opts.Car, scan: scan}
+
+	var last time.Time
+	lapCount := -1
+	err := scan(func(rec Record) error {
+		if !table.selected(rec) {
+			return nil
+		}
+		if table.Start.IsZero() {
+			table.Start = rec.Time
+		}
+		last = rec.Time
+		if rec.Timing != nil {
+			if lapCount >= 0 && rec.Timing.LapCount > lapCount {
+				table.Laps = append(table.Laps, rec.Time.Sub(table.Start).Seconds())
+			}
+			lapCount = rec.Timing.LapCount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if table.Start.IsZero() {
+		return table, nil
+	}
+
+	duration := last.Sub(table.Start).Seconds()
+	if duration*opts.Rate >= maxExportRows {
+		return nil, fmt.Errorf("rate too high, more than %d rows would be exported", maxExportRows)
+	}
+	table.Rows = int(duration*opts.Rate) + 1
+	return table, nil
+}
+
+// EachRow reads the session log again, calling fn with the values of each
+// row in turn. values is reused for the next row.
+func (t *exportTable) EachRow(fn func(row int, values []float64) error) error {
+	if t.Rows == 0 {
+		return nil
+	}
+
+	var lastTelemetry *telemetry.Telemetry
+	var lastTiming *telemetry.Timing
+	values := make([]float64, len(t.Channels))
+	row := 0
+	// sends the rows sampled before until
+	emit := func(until time.Time) error {
+		for ; row < t.Rows; row++ {
+			sampleTime := t.Start.Add(time.Duration(t.Time(row) * float64(time.Second)))
+			if !sampleTime.Before(until) {
+				return nil
+			}
+			for i, channel := range t.Channels {
+				value := math.NaN()
+				if channel.timing && lastTiming != nil {
+					value, _ = timingFieldValue(lastTiming, channel.Name)
+				} else if !channel.timing && lastTelemetry != nil {
+					value, _ = telemetryFieldValue(lastTelemetry, channel.Name)
+				}
+				if channel.convert != nil {
+					value = channel.convert(value)
+				}
+				values[i] = value
+			}
+			if err := fn(row, values); err != nil {
+				return err
+			}
+		}
+		return errStopScan
+	}
+
+	err := t.scan(func(rec Record) error {
+		if !t.selected(rec) || rec.Time.Before(t.Start) {
+			return nil
+		}
+		// a row holds the records received up to and including its time
+		if err := emit(rec.Time); err != nil {
+			return err
+		}
+		if rec.Telemetry != nil {
+			lastTelemetry = rec.Telemetry
+		}
+		if rec.Timing != nil {
+			lastTiming = rec.Timing
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the rows after the last record
+	if err := emit(t.Start.Add(time.Duration(t.Time(t.Rows) * float64(time.Second)))); err != errStopScan {
+		return err
+	}
+	return nil
+}
+
+// ExportSession writes a session log in the chosen format
+func ExportSession(w io.Writer, path string, opts ExportOptions) error {
+	table, err := buildExportTable(func(fn func(rec Record) error) error {
+		return ScanSession(path, fn)
+	}, opts)
+	if err != nil {
+		return err
+	}
+	return writeExport(w, table, opts)
+}
+
+func writeExport(w io.Writer, table *exportTable, opts ExportOptions) error {
+	switch opts.Format {
+	case ExportCSV:
+		return writeExportCSV(w, table)
+	case ExportMoTeC:
+		return writeExportMoTeC(w, table, opts.Car)
+	case ExportParquet:
+		return writeExportParquet(w, table)
+	}
+	return fmt.Errorf("unknown export format %q", opts.Format)
+}
+
+func formatExportValue(value float64) string {
+	if math.IsNaN(value) {
+		return ""
+	}
+	// most fields are float32, don't write out the noise from widening them
+	value, _ = strconv.ParseFloat(strconv.FormatFloat(value, 'g', 10, 64), 64)
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// one header row of "name (unit)" columns, then a row per sample
+func writeExportCSV(w io.Writer, table *exportTable) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("Time (s)")
+	for _, channel := range table.Channels {
+		buf.WriteString(",")
+		if channel.Unit != "" {
+			buf.WriteString(channel.Name + " (" + channel.Unit + ")")
+		} else {
+			buf.WriteString(channel.Name)
+		}
+	}
+	buf.WriteString("\n")
+
+	err := table.EachRow(func(row int, values []float64) error {
+		buf.WriteString(strconv.FormatFloat(table.Time(row), 'f', 3, 64))
+		for _, value := range values {
+			buf.WriteString(",")
+			buf.WriteString(formatExportValue(value))
+		}
+		_, err := buf.WriteString("\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// the CSV layout MoTeC i2 imports: quoted header fields describing the
+// outing, then channel names, channel units and the samples
+func writeExportMoTeC(w io.Writer, table *exportTable, car string) error {
+	buf := bufio.NewWriter(w)
+	line := func(fields ...string) {
+		for i, field := range fields {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(strconv.Quote(field))
+		}
+		buf.WriteString("\n")
+	}
+
+	var duration float64
+	if table.Rows > 0 {
+		duration = table.Time(table.Rows - 1)
+	}
+	laps := make([]string, len(table.Laps))
+	for i, lap := range table.Laps {
+		laps[i] = strconv.FormatFloat(lap, 'f', 3, 64)
+	}
+
+	line("Format", "MoTeC CSV File")
+	line("Venue", "")
+	line("Vehicle", car)
+	line("Driver", "")
+	line("Device", "lemonaid")
+	line("Comment", "")
+	line("Log Date", table.Start.Format("02/01/2006"))
+	line("Log Time", table.Start.Format("15:04:05"))
+	line("Sample Rate", strconv.FormatFloat(table.Rate, 'f', -1, 64))
+	line("Duration", strconv.FormatFloat(duration, 'f', 3, 64))
+	line("Range", "entire outing")
+	line(append([]string{"Beacon Markers"}, laps...)...)
+	buf.WriteString("\n\n")
+
+	names := []string{"Time"}
+	units := []string{"s"}
+	for _, channel := range table.Channels {
+		names = append(names, channel.Name)
+		units = append(units, channel.Unit)
+	}
+	line(names...)
+	line(units...)
+	buf.WriteString("\n\n")
+
+	fields := make([]string, len(table.Channels)+1)
+	err := table.EachRow(func(row int, values []float64) error {
+		fields[0] = strconv.FormatFloat(table.Time(row), 'f', 3, 64)
+		for i, value := range values {
+			if math.IsNaN(value) {
+				value = 0
+			}
+			fields[i+1] = formatExportValue(value)
+		}
+		line(fields...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// a Time column in seconds and an optional double column per channel,
+// written a row group at a time
+func writeExportParquet(w io.Writer, table *exportTable) error {
+	columns := []parquetColumn{{Name: "Time"}}
+	for _, channel := range table.Channels {
+		columns = append(columns, parquetColumn{Name: channel.Name, Optional: true})
+	}
+	p, err := newParquetWriter(w, columns)
+	if err != nil {
+		return errors.Wrap(err, "unable to write parquet")
+	}
+
+	group := make([][]float64, len(columns))
+	flush := func() error {
+		err := p.WriteRowGroup(group)
+		for i := range group {
+			group[i] = group[i][:0]
+		}
+		return err
+	}
+	err = table.EachRow(func(row int, values []float64) error {
+		group[0] = append(group[0], table.Time(row))
+		for i, value := range values {
+			group[i+1] = append(group[i+1], value)
+		}
+		if len(group[0]) == parquetRowGroupRows {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = p.Close()
+	}
+	return errors.Wrap(err, "unable to write parquet")
+}
+
+// reads export options from query parameters, or flags for the command line
+func parseExportOptions(format, car, channels, rate string) (ExportOptions, error) {
+	opts := ExportOptions{Format: format, Car: car, Rate: defaultExportRate}
+	if opts.Format == "" {
+		opts.Format = ExportCSV
+	}
+	switch opts.Format {
+	case ExportCSV, ExportParquet, ExportMoTeC:
+	default:
+		return opts, fmt.Errorf("unknown export format %q", opts.Format)
+	}
+	if opts.Car == "" {
+		opts.Car = defaultCarID
+	}
+	if rate != "" {
+		var err error
+		opts.Rate, err = strconv.ParseFloat(rate, 64)
+		if err != nil || opts.Rate <= 0 {
+			return opts, fmt.Errorf("invalid rate %q", rate)
+		}
+	}
+
+	var err error
+	opts.Channels, err = ParseExportChannels(channels)
+	return opts, err
+}
+
+// HTTP request handler that downloads a recorded session:
+//
+//	GET /api/sessions/{id}/export?format=csv|parquet|motec&channels=RPM,Speed:mph&rate=10&car=
+func SessionExportServer(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if id == "" || filepath.Base(id) != id {
+		http.NotFound(w, req)
+		return
+	}
+
+	opts, err := parseExportOptions(req.FormValue("format"), req.FormValue("car"), req.FormValue("channels"), req.FormValue("rate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(config.SessionDir, id+sessionExt)
+	table, err := buildExportTable(func(fn func(rec Record) error) error {
+		return ScanSession(path, fn)
+	}, opts)
+	if os.IsNotExist(errors.Cause(err)) {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filename := id + ".csv"
+	contentType := "text/csv"
+	switch opts.Format {
+	case ExportParquet:
+		filename = id + ".parquet"
+		contentType = "application/octet-stream"
+	case ExportMoTeC:
+		filename = id + "-motec.csv"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	if err := writeExport(w, table, opts); err != nil {
+		log.Println("unable to export session", id, err)
+	}
+}
+
+// exports a session file from the command line, to out or standard output
+func runExport(path, out string, opts ExportOptions) error {
+	// don't leave an empty export behind for a missing session
+	if _, err := os.Stat(path); err != nil {
+		return errors.Wrapf(err, "unable to open session log")
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return errors.Wrapf(err, "unable to create export file")
+		}
+		defer f.Close()
+		w = f
+	}
+	return ExportSession(w, path, opts)
+}
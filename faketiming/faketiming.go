@@ -0,0 +1,110 @@
+// Fake RMonitor race timing feed for testing the server's live timing
+// without being at the track. Run the server with:
+//
+//	lemonaid -timing localhost:50000 -car 42
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+type car struct {
+	regNumber string
+	number    string
+	team      string
+	// average lap time
+	pace    time.Duration
+	laps    int
+	elapsed time.Duration
+	nextLap time.Duration
+}
+
+func main() {
+	addr := flag.String("listen", ":50000", "address to serve the timing feed on")
+	lapScale := flag.Float64("scale", 0.1, "multiplier applied to lap times so laps go by quickly")
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal("listen:", err)
+	}
+	log.Println("serving timing feed on", *addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal("accept:", err)
+		}
+		go serve(conn, *lapScale)
+	}
+}
+
+func serve(conn net.Conn, lapScale float64) {
+	defer conn.Close()
+	log.Println("client connected", conn.RemoteAddr())
+
+	cars := []*car{
+		{regNumber: "1001", number: "7", team: "Damn Cheaters", pace: 2*time.Minute + 1*time.Second},
+		{regNumber: "1002", number: "42", team: "Thomas the LeMon", pace: 2*time.Minute + 3*time.Second},
+		{regNumber: "1003", number: "99", team: "Rust Bucket Racing", pace: 2*time.Minute + 6*time.Second},
+		{regNumber: "1004", number: "13", team: "Unlucky Streak", pace: 2*time.Minute + 10*time.Second},
+	}
+	for _, c := range cars {
+		if _, err := fmt.Fprintf(conn, "$A,\"%s\",\"%s\",0,\"%s\",\"\",\"USA\",1\r\n", c.regNumber, c.number, c.team); err != nil {
+			return
+		}
+		c.nextLap = lapTime(c)
+	}
+
+	start := time.Now()
+	for {
+		time.Sleep(100 * time.Millisecond)
+		elapsed := time.Duration(float64(time.Since(start)) / lapScale)
+
+		for _, c := range cars {
+			if elapsed < c.elapsed+c.nextLap {
+				continue
+			}
+			c.elapsed += c.nextLap
+			c.laps++
+			if _, err := fmt.Fprintf(conn, "$J,\"%s\",\"%s\",\"%s\"\r\n", c.regNumber, stamp(c.nextLap), stamp(c.elapsed)); err != nil {
+				log.Println("client disconnected", err)
+				return
+			}
+			c.nextLap = lapTime(c)
+
+			// positions are by laps completed, then by who got there first
+			ordered := append([]*car(nil), cars...)
+			sort.SliceStable(ordered, func(i, j int) bool {
+				if ordered[i].laps != ordered[j].laps {
+					return ordered[i].laps > ordered[j].laps
+				}
+				return ordered[i].elapsed < ordered[j].elapsed
+			})
+			for position, o := range ordered {
+				if _, err := fmt.Fprintf(conn, "$G,%d,\"%s\",%d,\"%s\"\r\n", position+1, o.regNumber, o.laps, stamp(o.elapsed)); err != nil {
+					log.Println("client disconnected", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// lap time within a couple of seconds of the car's pace
+func lapTime(c *car) time.Duration {
+	return c.pace + time.Duration(rand.Int63n(int64(4*time.Second))) - 2*time.Second
+}
+
+func stamp(d time.Duration) string {
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	seconds := (d - d.Truncate(time.Minute)).Seconds()
+	return fmt.Sprintf("%02d:%02d:%06.3f", hours, minutes, seconds)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"math"
+	"sync"
+	"time"
+)
+
+// consumption per minute is the trend over this much history
+const fuelWindow = 10 * time.Minute
+
+// the trend isn't trusted until it covers this much time
+const minFuelWindow = time.Minute
+
+// consumption per lap is averaged over this many laps
+const fuelLapsAveraged = 5
+
+// a rise in fuel remaining bigger than this is a refuel, smaller rises are
+// fuel sloshing around the sender
+const refuelThreshold = 1.0
+
+// fuel to have left when the car reaches the pits
+const fuelReserve = 0.5
+
+// the pit window opens this many laps before the last lap the car can pit on
+const pitWindowLaps = 3
+
+// how often the prediction is sent to clients
+const fuelPublishInterval = 5 * time.Second
+
+// names of the predictions that alert rules can use as a Field
+const (
+	alertFuelLapsRemaining    = "FuelLapsRemaining"
+	alertFuelMinutesRemaining = "FuelMinutesRemaining"
+)
+
+type fuelSample struct {
+	at   time.Time
+	fuel float64
+}
+
+// FuelModel estimates the car's fuel consumption from the fuel remaining
+// over time and at the end of each lap, and predicts when it will run out
+type FuelModel struct {
+	mu sync.Mutex
+
+	// since the last refuel, no older than fuelWindow
+	samples []fuelSample
+	current float64
+	// fuel used on each of the last laps
+	lapUsage []float64
+	// fuel remaining at the end of the last lap, NaN if unknown
+	lapStartFuel float64
+	lapCount     int
+
+	lastPublished time.Time
+}
+
+func NewFuelModel() *FuelModel {
+	return &FuelModel{lapStartFuel: math.NaN()}
+}
+
+// Add records the fuel remaining at the given time
+func (f *FuelModel) Add(fuel float64, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.samples) > 0 && fuel > f.current+refuelThreshold {
+		// the consumption is unchanged by a refuel but the trend and the
+		// lap in progress would be thrown off
+		f.samples = nil
+		f.lapStartFuel = math.NaN()
+		f.lastPublished = time.Time{}
+	}
+	f.current = fuel
+	f.samples = append(f.samples, fuelSample{at, fuel})
+
+	expired := 0
+	for expired < len(f.samples) && at.Sub(f.samples[expired].at) > fuelWindow {
+		expired++
+	}
+	f.samples = f.samples[expired:]
+}
+
+// Lap records that the car has completed lapCount laps, returning the fuel
+// used on the last lap if it could be measured
+func (f *FuelModel) Lap(lapCount int) (used float64, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lapCount <= f.lapCount || len(f.samples) == 0 {
+		f.lapCount = lapCount
+		return 0, false
+	}
+
+	// only a single lap can be measured, a jump in the count is the timing
+	// feed catching up
+	if !math.IsNaN(f.lapStartFuel) && lapCount == f.lapCount+1 {
+		if used = f.lapStartFuel - f.current; used > 0 {
+			ok = true
+			f.lapUsage = append(f.lapUsage, used)
+			if len(f.lapUsage) > fuelLapsAveraged {
+				f.lapUsage = f.lapUsage[1:]
+			}
+		}
+	}
+	f.lapCount = lapCount
+	f.lapStartFuel = f.current
+	f.lastPublished = time.Time{}
+	return used, ok
+}
+
+// least squares slope of fuel against time, in fuel per minute used
+func (f *FuelModel) perMinute() (float64, bool) {
+	if len(f.samples) < 2 || f.samples[len(f.samples)-1].at.Sub(f.samples[0].at) < minFuelWindow {
+		return 0, false
+	}
+
+	start := f.samples[0].at
+	var n, sumX, sumY, sumXX, sumXY float64
+	for _, s := range f.samples {
+		x := s.at.Sub(start).Minutes()
+		n++
+		sumX += x
+		sumY += s.fuel
+		sumXX += x * x
+		sumXY += x * s.fuel
+	}
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+	used := -(n*sumXY - sumX*sumY) / denom
+	return used, used > 0
+}
+
+// Predict returns the current estimate, and the values alert rules can use
+func (f *FuelModel) Predict() (telemetry.FuelPrediction, map[string]float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prediction := telemetry.FuelPrediction{Remaining: f.current}
+	derived := make(map[string]float64)
+
+	if perMinute, ok := f.perMinute(); ok {
+		prediction.PerMinute = perMinute
+		minutes := f.current / perMinute
+		prediction.TimeRemaining = telemetry.JSONDuration(time.Duration(minutes * float64(time.Minute)))
+		derived[alertFuelMinutesRemaining] = minutes
+	}
+
+	if len(f.lapUsage) > 0 {
+		var total float64
+		for _, used := range f.lapUsage {
+			total += used
+		}
+		perLap := total / float64(len(f.lapUsage))
+		prediction.PerLap = perLap
+		prediction.LapsRemaining = f.current / perLap
+		derived[alertFuelLapsRemaining] = prediction.LapsRemaining
+
+		lastLap := f.lapCount + int(math.Floor((f.current-fuelReserve)/perLap))
+		if lastLap < f.lapCount {
+			lastLap = f.lapCount
+		}
+		prediction.PitWindowClose = lastLap
+		prediction.PitWindowOpen = lastLap - pitWindowLaps
+		if prediction.PitWindowOpen < f.lapCount {
+			prediction.PitWindowOpen = f.lapCount
+		}
+	}
+	return prediction, derived
+}
+
+// due reports whether the prediction should be sent to clients, it is
+// sent periodically and as soon as a lap is completed
+func (f *FuelModel) due(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.lastPublished) < fuelPublishInterval {
+		return false
+	}
+	f.lastPublished = now
+	return true
+}
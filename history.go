@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// most points returned for each field, longer ranges are downsampled to fit
+const maxHistoryPoints = 5000
+
+// returned when the resolution asked for is too fine for the range
+var errTooManyPoints = fmt.Errorf("more than %d points would be returned", maxHistoryPoints)
+
+// A time series of telemetry fields read from a recorded session. Each
+// point is the average of the frames received during Resolution seconds,
+// or a single frame when Resolution is zero.
+type TelemetryHistory struct {
+	Session    string
+	Car        string
+	From       time.Time
+	To         time.Time
+	Resolution float64
+	Time       []time.Time
+	Values     map[string][]float64
+}
+
+// every numeric Telemetry field, the fields returned when none are asked for
+func telemetryFieldNames() []string {
+	var names []string
+	typ := reflect.TypeOf(telemetry.Telemetry{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if _, err := telemetryFieldValue(&telemetry.Telemetry{}, name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parses a time given either as RFC 3339 or as seconds from start
+func parseHistoryTime(value string, start time.Time) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return start.Add(time.Duration(seconds * float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected RFC 3339 or seconds from the start of the session", value)
+	}
+	return t, nil
+}
+
+// QueryTelemetry returns the named fields from the telemetry the car sent
+// between from and to, averaged over resolution. A zero from or to is the
+// start or end of the session, and a zero resolution is chosen so that no
+// more than maxHistoryPoints are returned. Values are in the units of the
+// live stream. scan is called once to find the range of the telemetry and
+// once more to read it, so only the points returned are held in memory.
+// Fields named more than once are returned once.
+func QueryTelemetry(scan func(fn func(rec Record) error) error, car string, fields []string, from, to time.Time, resolution time.Duration) (*TelemetryHistory, error) {
+	history := &TelemetryHistory{
+		Car:    car,
+		From:   from,
+		To:     to,
+		Time:   []time.Time{},
+		Values: make(map[string][]float64),
+	}
+	unique := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if _, ok := history.Values[field]; !ok {
+			unique = append(unique, field)
+			history.Values[field] = []float64{}
+		}
+	}
+	fields = unique
+
+	selected := func(rec Record) bool {
+		recCar := rec.Car
+		if recCar == "" {
+			recCar = defaultCarID
+		}
+		if rec.Telemetry == nil || recCar != car {
+			return false
+		}
+		return (from.IsZero() || !rec.Time.Before(from)) && (to.IsZero() || !rec.Time.After(to))
+	}
+
+	var first, last time.Time
+	count := 0
+	err := scan(func(rec Record) error {
+		if selected(rec) {
+			if count == 0 {
+				first = rec.Time
+			}
+			last = rec.Time
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return history, nil
+	}
+
+	if history.From.IsZero() {
+		history.From = first
+	}
+	if history.To.IsZero() {
+		history.To = last
+	}
+	if resolution == 0 && count > maxHistoryPoints {
+		resolution = last.Sub(first)/(maxHistoryPoints-1) + 1
+	}
+	if resolution > 0 && last.Sub(first)/resolution >= maxHistoryPoints {
+		return nil, errors.Wrap(errTooManyPoints, "resolution too fine")
+	}
+	history.Resolution = resolution.Seconds()
+
+	// sums of each field in the current bucket
+	sums := make([]float64, len(fields))
+	count = 0
+	var bucket time.Time
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		history.Time = append(history.Time, bucket)
+		for i, field := range fields {
+			history.Values[field] = append(history.Values[field], sums[i]/float64(count))
+			sums[i] = 0
+		}
+		count = 0
+	}
+
+	err = scan(func(rec Record) error {
+		// the log may have been appended to since the first pass
+		if !selected(rec) || rec.Time.After(last) {
+			return nil
+		}
+		t := rec.Time
+		if resolution > 0 {
+			t = first.Add(rec.Time.Sub(first) / resolution * resolution)
+		}
+		if count > 0 && !t.Equal(bucket) {
+			flush()
+		}
+		bucket = t
+		live := liveUnits(*rec.Telemetry)
+		for i, field := range fields {
+			value, err := telemetryFieldValue(&live, field)
+			if err != nil {
+				return err
+			}
+			sums[i] += value
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+	return history, nil
+}
+
+// HTTP request handler listing the recorded sessions
+func SessionsServer(w http.ResponseWriter, req *http.Request) {
+	sessions, err := ListSessions(config.SessionDir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sessions == nil {
+		sessions = []Session{}
+	}
+
+	b, err := json.Marshal(sessions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// HTTP request handler returning a time series of telemetry from a
+// recorded session:
+//
+//	GET /api/sessions/{id}/telemetry?from=&to=&fields=RPM,Speed&resolution=1&car=
+//
+// from and to are RFC 3339 times or seconds from the start of the session,
+// resolution is in seconds.
+func SessionTelemetryServer(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if id == "" || filepath.Base(id) != id {
+		http.NotFound(w, req)
+		return
+	}
+	path := filepath.Join(config.SessionDir, id+sessionExt)
+	scan := func(fn func(rec Record) error) error {
+		return ScanSession(path, fn)
+	}
+
+	// relative times are from the first record in the session
+	var start time.Time
+	err := scan(func(rec Record) error {
+		start = rec.Time
+		return errStopScan
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	car := req.FormValue("car")
+	if car == "" {
+		car = defaultCarID
+	}
+
+	fields := telemetryFieldNames()
+	if value := req.FormValue("fields"); value != "" {
+		fields = strings.Split(value, ",")
+		seen := make(map[string]bool)
+		for _, field := range fields {
+			if _, err := telemetryFieldValue(&telemetry.Telemetry{}, field); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if seen[field] {
+				http.Error(w, fmt.Sprintf("field %q is asked for more than once", field), http.StatusBadRequest)
+				return
+			}
+			seen[field] = true
+		}
+	}
+
+	var from, to time.Time
+	if value := req.FormValue("from"); value != "" {
+		if from, err = parseHistoryTime(value, start); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := req.FormValue("to"); value != "" {
+		if to, err = parseHistoryTime(value, start); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var resolution time.Duration
+	if value := req.FormValue("resolution"); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			http.Error(w, fmt.Sprintf("invalid resolution %q", value), http.StatusBadRequest)
+			return
+		}
+		resolution = time.Duration(seconds * float64(time.Second))
+	}
+
+	history, err := QueryTelemetry(scan, car, fields, from, to, resolution)
+	if errors.Cause(err) == errTooManyPoints {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history.Session = id
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a subscriber that misses this many messages in a row is too slow to keep
+// up and is disconnected
+const maxConsecutiveDrops = 50
+
+// Hub fans messages out to every subscribed client. A subscriber that can't
+// keep up has messages dropped rather than holding up everyone else, and is
+// evicted if it falls too far behind.
+type Hub struct {
+	name string
+
+	send        chan []byte
+	subscribe   chan *Subscriber
+	unsubscribe chan *Subscriber
+	list        chan chan []SubscriberStats
+	stop        chan struct{}
+	stopOnce    sync.Once
+	wg          sync.WaitGroup
+
+	// messages that couldn't be queued for the hub at all
+	dropped uint64
+	// messages dropped for slow subscribers, including ones since
+	// disconnected
+	subscriberDropped uint64
+}
+
+// Subscriber receives messages from a Hub on C until it unsubscribes, is
+// evicted or the hub is closed, at which point C is closed
+type Subscriber struct {
+	C <-chan []byte
+
+	c         chan []byte
+	name      string
+	connected time.Time
+
+	sent             uint64
+	dropped          uint64
+	consecutiveDrops int
+}
+
+// SubscriberStats describes a connected client
+type SubscriberStats struct {
+	Name      string
+	Connected time.Time
+	Sent      uint64
+	Dropped   uint64
+}
+
+func NewHub(name string) *Hub {
+	return &Hub{
+		name:        name,
+		send:        make(chan []byte, config.HubBufferSize),
+		subscribe:   make(chan *Subscriber),
+		unsubscribe: make(chan *Subscriber),
+		list:        make(chan chan []SubscriberStats),
+		stop:        make(chan struct{}),
+	}
+}
+
+func (h *Hub) Start() {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		subscribers := make(map[*Subscriber]bool)
+		remove := func(s *Subscriber) {
+			if subscribers[s] {
+				delete(subscribers, s)
+				close(s.c)
+			}
+		}
+
+		for {
+			select {
+			case s := <-h.subscribe:
+				log.Println("Adding", h.name, "client", s.name)
+				subscribers[s] = true
+			case s := <-h.unsubscribe:
+				if subscribers[s] {
+					log.Println("Removing", h.name, "client", s.name)
+				}
+				remove(s)
+			case msg := <-h.send:
+				for s := range subscribers {
+					select {
+					case s.c <- msg:
+						s.sent++
+						s.consecutiveDrops = 0
+					default:
+						atomic.AddUint64(&s.dropped, 1)
+						atomic.AddUint64(&h.subscriberDropped, 1)
+						s.consecutiveDrops++
+						if s.consecutiveDrops >= maxConsecutiveDrops {
+							log.Println("Evicting slow", h.name, "client", s.name, "after", s.consecutiveDrops, "dropped messages")
+							remove(s)
+						}
+					}
+				}
+			case reply := <-h.list:
+				stats := make([]SubscriberStats, 0, len(subscribers))
+				for s := range subscribers {
+					stats = append(stats, SubscriberStats{
+						Name:      s.name,
+						Connected: s.connected,
+						Sent:      s.sent,
+						Dropped:   atomic.LoadUint64(&s.dropped),
+					})
+				}
+				reply <- stats
+			case <-h.stop:
+				for s := range subscribers {
+					remove(s)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Close disconnects every subscriber and stops the hub
+func (h *Hub) Close() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+	h.wg.Wait()
+}
+
+// Subscribe registers a new client, name is used in logs and stats
+func (h *Hub) Subscribe(name string) *Subscriber {
+	c := make(chan []byte, config.SubscriberBufferSize)
+	s := &Subscriber{
+		C:         c,
+		c:         c,
+		name:      name,
+		connected: time.Now(),
+	}
+	select {
+	case h.subscribe <- s:
+	case <-h.stop:
+		close(c)
+	}
+	return s
+}
+
+// Unsubscribe removes a client, it is safe to call after the client has
+// been evicted
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	select {
+	case h.unsubscribe <- s:
+	case <-h.stop:
+	}
+}
+
+// Send queues a message for every subscriber without blocking. It returns
+// false if the hub is backed up and the message was dropped.
+func (h *Hub) Send(msg []byte) bool {
+	select {
+	case h.send <- msg:
+		return true
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+		return false
+	}
+}
+
+// Subscribers returns the clients that are currently connected
+func (h *Hub) Subscribers() []SubscriberStats {
+	reply := make(chan []SubscriberStats)
+	select {
+	case h.list <- reply:
+		return <-reply
+	case <-h.stop:
+		return nil
+	}
+}
+
+// Dropped returns how many messages the hub couldn't accept
+func (h *Hub) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// SubscriberDropped returns how many messages have been dropped for slow
+// subscribers
+func (h *Hub) SubscriberDropped() uint64 {
+	return atomic.LoadUint64(&h.subscriberDropped)
+}
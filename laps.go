@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crossings of the line closer together than this are GPS jitter, or the
+// car reversing over the line, not a lap
+const minLapTime = 20 * time.Second
+
+// completed laps kept for each car
+const maxLapHistory = 200
+
+// frames kept for the lap in progress, half an hour at 10 frames a second.
+// A lap that runs longer, e.g. stopped in the pits, keeps only its first
+// frames.
+const maxLapFrames = 18000
+
+// the GPS lap times are only published once the timing feed has been quiet
+// for this long, so they don't fight with the official times
+const externalTimingTimeout = 2 * time.Minute
+
+// metres per degree of latitude
+const metresPerDegree = 111320
+
+type GPSPoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// GPSLine is a line across the track between two points, e.g. either side
+// of the start/finish line. A is on the left of a car driving in the race
+// direction and B on its right, the line only counts as crossed in that
+// direction.
+type GPSLine struct {
+	A GPSPoint
+	B GPSPoint
+}
+
+// ParseGPSLine parses "lat,lon,lat,lon"
+func ParseGPSLine(value string) (GPSLine, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return GPSLine{}, fmt.Errorf("line %q must be lat,lon,lat,lon", value)
+	}
+	var coords [4]float64
+	for i, part := range parts {
+		var err error
+		coords[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return GPSLine{}, fmt.Errorf("invalid coordinate %q", part)
+		}
+	}
+	return GPSLine{
+		A: GPSPoint{coords[0], coords[1]},
+		B: GPSPoint{coords[2], coords[3]},
+	}, nil
+}
+
+// projects a point to metres east and north of the start of the line,
+// accurate enough over the length of a race track
+func (l GPSLine) project(p GPSPoint) (x, y float64) {
+	x = (p.Longitude - l.A.Longitude) * metresPerDegree * math.Cos(l.A.Latitude*math.Pi/180)
+	y = (p.Latitude - l.A.Latitude) * metresPerDegree
+	return x, y
+}
+
+// crossing returns how far along the path from one point to the next the
+// line is crossed, from 0 to 1, and false if it isn't crossed or is crossed
+// against the race direction, e.g. reversing back over it
+func (l GPSLine) crossing(from, to GPSPoint) (float64, bool) {
+	px, py := l.project(from)
+	qx, qy := l.project(to)
+	bx, by := l.project(l.B)
+
+	// solve from + t*(to-from) = A + u*(B-A), A is the origin
+	rx, ry := qx-px, qy-py
+	denom := rx*by - ry*bx
+	// crossed the wrong way, A to B must be the car's left to right, or
+	// moving along the line
+	if denom >= 0 {
+		return 0, false
+	}
+	t := (bx*py - by*px) / denom
+	u := (rx*py - ry*px) / denom
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return 0, false
+	}
+	return t, true
+}
+
+// Lap is a completed lap, Telemetry holds the frames received during it
+type Lap struct {
+	Number int
+	Start  time.Time
+	Time   telemetry.JSONDuration
+	// only set if every sector line was crossed during the lap
+	Sectors   []telemetry.JSONDuration `json:",omitempty"`
+	Telemetry []telemetry.Telemetry    `json:",omitempty"`
+}
+
+// LapDetector finds laps and sectors by watching for the car crossing the
+// track's lines. The crossing time is interpolated between the GPS fixes
+// either side of the line.
+type LapDetector struct {
+	track Track
+
+	mu       sync.Mutex
+	havePrev bool
+	prev     GPSPoint
+	prevTime time.Time
+	// zero until the car first crosses the start/finish line
+	lapStart time.Time
+	current  []telemetry.Telemetry
+
+	// the sector line last crossed, zero for the start/finish line
+	lastLine     int
+	lastLineTime time.Time
+	// sector times of the current lap, nil if a sector line was missed
+	splits      []time.Duration
+	bestSectors []time.Duration
+
+	laps  []Lap
+	count int
+	best  time.Duration
+}
+
+func NewLapDetector(track Track) *LapDetector {
+	return &LapDetector{
+		track:       track,
+		bestSectors: make([]time.Duration, len(track.Sectors)+1),
+	}
+}
+
+// Update adds a frame received at the given time. It returns the lap the
+// frame completed, and the sector timing if it completed a sector.
+func (d *LapDetector) Update(t telemetry.Telemetry, at time.Time) (*Lap, *telemetry.SectorTiming) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pos := GPSPoint{t.Latitude, t.Longitude}
+	if pos.Latitude == 0 && pos.Longitude == 0 {
+		// no GPS fix
+		d.keep(t)
+		return nil, nil
+	}
+
+	var completed *Lap
+	var sector *telemetry.SectorTiming
+	if d.havePrev {
+		crossedAt := func(line GPSLine) (time.Time, bool) {
+			fraction, ok := line.crossing(d.prev, pos)
+			return d.prevTime.Add(time.Duration(fraction * float64(at.Sub(d.prevTime)))), ok
+		}
+		if crossed, ok := crossedAt(d.track.StartFinish); ok {
+			completed, sector = d.crossed(crossed)
+		} else if next := d.lastLine + 1; !d.lapStart.IsZero() && next <= len(d.track.Sectors) {
+			if crossed, ok := crossedAt(d.track.Sectors[next-1]); ok {
+				sector = d.split(next, crossed)
+			}
+		}
+	}
+	d.havePrev = true
+	d.prev = pos
+	d.prevTime = at
+
+	d.keep(t)
+	return completed, sector
+}
+
+// adds a frame to the lap in progress
+func (d *LapDetector) keep(t telemetry.Telemetry) {
+	if !d.lapStart.IsZero() && len(d.current) < maxLapFrames {
+		d.current = append(d.current, t)
+	}
+}
+
+// times the sector ending at line, the start/finish line is len(Sectors)+1
+func (d *LapDetector) split(line int, at time.Time) *telemetry.SectorTiming {
+	splitTime := at.Sub(d.lastLineTime)
+	d.lastLine = line
+	d.lastLineTime = at
+	if d.splits == nil || len(d.track.Sectors) == 0 {
+		return nil
+	}
+	d.splits = append(d.splits, splitTime)
+
+	i := len(d.splits) - 1
+	sector := &telemetry.SectorTiming{
+		Lap:    d.count + 1,
+		Sector: len(d.splits),
+		Time:   telemetry.JSONDuration(splitTime),
+	}
+	if previous := d.bestSectors[i]; previous != 0 {
+		sector.Delta = (splitTime - previous).Seconds()
+	}
+	if d.bestSectors[i] == 0 || splitTime < d.bestSectors[i] {
+		d.bestSectors[i] = splitTime
+	}
+	sector.Best = telemetry.JSONDuration(d.bestSectors[i])
+
+	var theoretical time.Duration
+	for _, best := range d.bestSectors {
+		if best == 0 {
+			theoretical = 0
+			break
+		}
+		theoretical += best
+	}
+	sector.TheoreticalBest = telemetry.JSONDuration(theoretical)
+	for _, split := range d.splits {
+		sector.Splits = append(sector.Splits, telemetry.JSONDuration(split))
+	}
+	return sector
+}
+
+// starts a new lap at the crossing of the start/finish line, returning the
+// lap that was finished and its last sector
+func (d *LapDetector) crossed(at time.Time) (*Lap, *telemetry.SectorTiming) {
+	if d.lapStart.IsZero() {
+		d.startLap(at)
+		return nil, nil
+	}
+
+	lapTime := at.Sub(d.lapStart)
+	if lapTime < minLapTime {
+		return nil, nil
+	}
+
+	// the final sector only counts if every other sector line was crossed
+	if d.lastLine != len(d.track.Sectors) {
+		d.splits = nil
+	}
+	sector := d.split(len(d.track.Sectors)+1, at)
+
+	d.count++
+	lap := Lap{
+		Number:    d.count,
+		Start:     d.lapStart,
+		Time:      telemetry.JSONDuration(lapTime),
+		Telemetry: d.current,
+	}
+	if d.splits != nil && len(d.track.Sectors) > 0 {
+		for _, split := range d.splits {
+			lap.Sectors = append(lap.Sectors, telemetry.JSONDuration(split))
+		}
+	}
+	if d.best == 0 || lapTime < d.best {
+		d.best = lapTime
+	}
+
+	d.laps = append(d.laps, lap)
+	if len(d.laps) > maxLapHistory {
+		d.laps = d.laps[len(d.laps)-maxLapHistory:]
+	}
+	d.startLap(at)
+	return &lap, sector
+}
+
+func (d *LapDetector) startLap(at time.Time) {
+	d.lapStart = at
+	d.lastLine = 0
+	d.lastLineTime = at
+	d.splits = []time.Duration{}
+	d.current = nil
+}
+
+// Laps returns the completed laps without their telemetry
+func (d *LapDetector) Laps() []Lap {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	laps := make([]Lap, len(d.laps))
+	for i, lap := range d.laps {
+		lap.Telemetry = nil
+		laps[i] = lap
+	}
+	return laps
+}
+
+// Lap returns a completed lap and its telemetry
+func (d *LapDetector) Lap(number int) (Lap, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, lap := range d.laps {
+		if lap.Number == number {
+			return lap, true
+		}
+	}
+	return Lap{}, false
+}
+
+// adds the detected lap to the car's timing and publishes it, unless a
+// timing feed is providing lap times
+func (car *Car) publishLap(lap *Lap) error {
+	car.lock.RLock()
+	timing := car.lastTiming
+	external := car.lastExternalTiming
+	car.lock.RUnlock()
+	if time.Since(external) < externalTimingTimeout {
+		return nil
+	}
+
+	car.laps.mu.Lock()
+	timing.LapCount = car.laps.count
+	timing.BestLap = telemetry.JSONDuration(car.laps.best)
+	car.laps.mu.Unlock()
+	timing.LastLap = lap.Time
+	return car.publish(timing)
+}
+
+// HTTP request handler listing a car's laps, or with a lap number the
+// telemetry received during the lap:
+//
+//	GET /laps/{car}
+//	GET /laps/{car}/{lap}
+func LapsServer(w http.ResponseWriter, req *http.Request) {
+	car, ok := requestCar(req)
+	if !ok || car.laps == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	var data interface{}
+	if value, ok := mux.Vars(req)["lap"]; ok {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid lap %q", value), http.StatusBadRequest)
+			return
+		}
+		lap, ok := car.laps.Lap(number)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		data = lap
+	} else {
+		data = car.laps.Laps()
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
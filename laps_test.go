@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"testing"
+	"time"
+)
+
+// position on the test square after driving distance degrees clockwise from
+// its south west corner
+func squarePosition(distance float64) GPSPoint {
+	const side = 0.01
+	south, west := 38.0, -122.0
+	for distance >= 4*side {
+		distance -= 4 * side
+	}
+	switch {
+	case distance < side:
+		return GPSPoint{south + distance, west}
+	case distance < 2*side:
+		return GPSPoint{south + side, west + distance - side}
+	case distance < 3*side:
+		return GPSPoint{south + side - (distance - 2*side), west + side}
+	default:
+		return GPSPoint{south, west + side - (distance - 3*side)}
+	}
+}
+
+func durationsNear(got []telemetry.JSONDuration, want []time.Duration) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		diff := time.Duration(got[i]) - want[i]
+		if diff < -time.Millisecond || diff > time.Millisecond {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLapDetector(t *testing.T) {
+	tracks, err := LoadTracks("testdata/tracks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, ok := tracks["test-square"]
+	if !ok {
+		t.Fatal("test track missing")
+	}
+	d := NewLapDetector(track)
+
+	// a fix a second from the south east corner, at 0.0004 degrees a
+	// second until 130s then 0.0005. The start/finish line is crossed at
+	// 12.5s, the first lap takes 100s with sectors of 50s, 25s and 25s, and
+	// the second speeds up part way through its first sector.
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	distance := 0.03
+	var laps []*Lap
+	var sectors []*telemetry.SectorTiming
+	for second := 0; second <= 210; second++ {
+		pos := squarePosition(distance)
+		lap, sector := d.Update(telemetry.Telemetry{Latitude: pos.Latitude, Longitude: pos.Longitude}, start.Add(time.Duration(second)*time.Second))
+		if lap != nil {
+			laps = append(laps, lap)
+		}
+		if sector != nil {
+			sectors = append(sectors, sector)
+		}
+		if second < 130 {
+			distance += 0.0004
+		} else {
+			distance += 0.0005
+		}
+	}
+
+	wantLaps := []struct {
+		start   time.Duration
+		time    time.Duration
+		sectors []time.Duration
+	}{
+		{12500 * time.Millisecond, 100 * time.Second, []time.Duration{50 * time.Second, 25 * time.Second, 25 * time.Second}},
+		{112500 * time.Millisecond, 83500 * time.Millisecond, []time.Duration{43500 * time.Millisecond, 20 * time.Second, 20 * time.Second}},
+	}
+	if len(laps) != len(wantLaps) {
+		t.Fatalf("%d laps, want %d", len(laps), len(wantLaps))
+	}
+	for i, want := range wantLaps {
+		lap := laps[i]
+		if lap.Number != i+1 {
+			t.Errorf("lap %d numbered %d", i+1, lap.Number)
+		}
+		if !durationsNear([]telemetry.JSONDuration{telemetry.JSONDuration(lap.Start.Sub(start)), lap.Time}, []time.Duration{want.start, want.time}) {
+			t.Errorf("lap %d started at %s and took %s, want %s and %s", i+1, lap.Start.Sub(start), time.Duration(lap.Time), want.start, want.time)
+		}
+		if !durationsNear(lap.Sectors, want.sectors) {
+			t.Errorf("lap %d sectors %v, want %v", i+1, lap.Sectors, want.sectors)
+		}
+	}
+
+	// the second lap's sectors are all best times
+	if len(sectors) != 6 {
+		t.Fatalf("%d sector timings, want 6", len(sectors))
+	}
+	last := sectors[5]
+	if last.Lap != 2 || last.Sector != 3 {
+		t.Errorf("last sector timing is lap %d sector %d, want lap 2 sector 3", last.Lap, last.Sector)
+	}
+	if !durationsNear([]telemetry.JSONDuration{last.Best, last.TheoreticalBest}, []time.Duration{20 * time.Second, 83500 * time.Millisecond}) {
+		t.Errorf("best %s, theoretical best %s", time.Duration(last.Best), time.Duration(last.TheoreticalBest))
+	}
+	if first := sectors[3]; first.Delta < -6.501 || first.Delta > -6.499 {
+		t.Errorf("lap 2 sector 1 delta %v, want -6.5", first.Delta)
+	}
+}
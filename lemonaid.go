@@ -1,57 +1,87 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"github.com/gorilla/mux"
 	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
-// used to control access to lastTelemetry
-var lock sync.RWMutex
+// evaluates the warning/error thresholds for received telemetry
+var alerts *AlertEngine
 
-// used by the websocket handler that is receiving the uplinked telemetry to
-// broadcast to clients
-var sendChannel chan []byte
+// writes every received frame to the session log
+var recorder *Recorder
 
-var videoSyncedSendChannel chan SyncedMessage
+// rejects uplinked frames that aren't from our car
+var uplinkAuth *UplinkAuth
 
-var videoDelay time.Duration = time.Second * 63
+// HTTP request handler for telemetry
+func TelemetryServer(w http.ResponseWriter, req *http.Request) {
+	car, ok := requestCar(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
 
-// Video synchronized message
-type SyncedMessage struct {
-	QueuedTime time.Time
-	Message    []byte
-}
+	car.lock.RLock()
+	b, err := car.lastTelemetry.JSONEncode()
+	car.lock.RUnlock()
 
-// contains the last received telemetry values so that it
-// can be sent to newly connecting clients between receives
-// of telemetry and any HTTP requests
-var lastTelemetry = telemetry.TelemetryWithStatus{
-	Telemetry: &telemetry.Telemetry{
-		Latitude:       35.488151852742455,
-		Longitude:      -119.53969199955463,
-		RPM:            4321,
-		Speed:          90,
-		CoolantTemp:    60,
-		OilTemp:        104,
-		BatteryVoltage: 11.3,
-		FuelRemaining:  90,
-	},
-	WarningFields: []string{""},
-	ErrorFields:   []string{""},
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-var lastTimingTelemetry = telemetry.Timing{}
+// HTTP request handler listing the cars that dashboards can select
+func CarsServer(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(CarIDs())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
 
-// HTTP request handler for telemetry
-func TelemetryServer(w http.ResponseWriter, req *http.Request) {
-	lock.RLock()
-	b, err := lastTelemetry.JSONEncode()
-	lock.RUnlock()
+// HTTP request handler listing the clients connected to each car
+func ClientsServer(w http.ResponseWriter, req *http.Request) {
+	type carClients struct {
+		Live             []SubscriberStats
+		LiveDropped      uint64
+		VideoSync        []VideoSyncClientStats
+		VideoSyncDropped uint64
+	}
+	clients := make(map[string]carClients)
+	for _, id := range CarIDs() {
+		car, ok := LookupCar(id)
+		if !ok {
+			continue
+		}
+		clients[id] = carClients{
+			Live:             car.hub.Subscribers(),
+			LiveDropped:      car.hub.Dropped(),
+			VideoSync:        car.videoSync.Clients(),
+			VideoSyncDropped: car.videoSync.Dropped(),
+		}
+	}
 
+	b, err := json.Marshal(clients)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -60,129 +90,310 @@ func TelemetryServer(w http.ResponseWriter, req *http.Request) {
 	w.Write(b)
 }
 
+// the car named in the request path, or the default car
+func requestCar(req *http.Request) (*Car, bool) {
+	id, ok := mux.Vars(req)["car"]
+	if !ok {
+		id = defaultCarID
+	}
+	return LookupCar(id)
+}
+
 func main() {
-	// Realtime broadcast channels
-	sendChannel = make(chan []byte, 3)
-	addChannel := make(chan chan []byte)
-	delChannel := make(chan chan []byte)
-
-	// broadcaster go function: receives telemetry and sends to all
-	// registered client channels. Client channels are added and deleted
-	// via additional channels
-	go func() {
-		outgoingWebChannels := make([]chan []byte, 0, 100)
-		for {
-			select {
-			case c := <-addChannel:
-				log.Println("Adding client")
-				outgoingWebChannels = append(outgoingWebChannels, c)
-			case c := <-delChannel:
-				log.Println("Removing client")
-				b := outgoingWebChannels[:0]
-				for _, x := range outgoingWebChannels {
-					if x != c {
-						b = append(b, x)
-					}
-				}
-				outgoingWebChannels = b
-			case t := <-sendChannel:
-				for c := range outgoingWebChannels {
-					select {
-					case outgoingWebChannels[c] <- t:
-					default:
-					}
-				}
-			}
+	replayPath := flag.String("replay", "", "replay a recorded session file instead of receiving live telemetry")
+	configPath := flag.String("config", os.Getenv("LEMONAID_CONFIG"), "config file, defaults to "+defaultConfigFile+" if it exists")
+	exportPath := flag.String("export", "", "export a recorded session file and exit")
+	exportOut := flag.String("export-out", "", "file to export to, defaults to standard output")
+	exportFormat := flag.String("export-format", ExportCSV, "export format: csv, parquet or motec")
+	exportChannels := flag.String("export-channels", "", "channels to export with optional units, e.g. RPM,Speed:mph, defaults to all")
+	exportRate := flag.String("export-rate", strconv.Itoa(defaultExportRate), "samples per second to export")
+	exportCar := flag.String("export-car", defaultCarID, "car to export")
+	configFlags := ConfigFlags()
+	flag.Parse()
+
+	var err error
+	config, err = LoadConfig(*configPath, configFlags)
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+	videoDelay.Set(time.Duration(config.VideoDelay))
+
+	if *exportPath != "" {
+		opts, err := parseExportOptions(*exportFormat, *exportCar, *exportChannels, *exportRate)
+		if err == nil {
+			err = runExport(*exportPath, *exportOut, opts)
 		}
-	}()
+		if err != nil {
+			log.Fatal("unable to export session: ", err)
+		}
+		return
+	}
+
+	uplinkAuth = NewUplinkAuth(config.UplinkKey, config.UplinkToken)
+	replaying = *replayPath != ""
 
-	udpServer, err := NewUDPIncoming()
+	if config.Track != "" {
+		tracks, err := LoadTracks(config.TracksFile)
+		if err != nil {
+			log.Println("unable to load tracks", err)
+			return
+		}
+		track, ok := tracks[config.Track]
+		if !ok {
+			log.Println("unknown track", config.Track)
+			return
+		}
+		currentTrack = &track
+	}
+	if config.StartFinish != "" {
+		line, err := ParseGPSLine(config.StartFinish)
+		if err != nil {
+			log.Println("invalid start/finish line", err)
+			return
+		}
+		// overrides the line of the chosen track
+		if currentTrack == nil {
+			currentTrack = &Track{Name: "custom"}
+		}
+		currentTrack.StartFinish = line
+	}
+	if config.PitLane != "" {
+		polygon, err := ParseGPSPolygon(config.PitLane)
+		if err != nil {
+			log.Println("invalid pit lane", err)
+			return
+		}
+		if currentTrack == nil {
+			currentTrack = &Track{Name: "custom"}
+		}
+		currentTrack.PitLane = polygon
+	}
+
+	// the timing feed and frames without a car id are for the default car
+	defaultCar, err := GetCar(defaultCarID)
 	if err != nil {
-		log.Println("unable to create UDP server", err)
+		log.Println("unable to create default car", err)
 		return
 	}
-	udpServer.Start()
-	defer udpServer.Close()
+	for _, id := range config.Cars {
+		if _, err := GetCar(id); err != nil {
+			log.Println("unable to create car", err)
+			return
+		}
+	}
 
-	// assume we can't back-up more than 3600 telemetry messages
-	videoSyncedSendChannel = make(chan SyncedMessage, 3600)
-	videoSyncedAddChannel := make(chan chan []byte)
-	videoSyncedDelChannel := make(chan chan []byte)
+	alerts, err = NewAlertEngine(config.AlertRulesFile, defaultAlertRules)
+	if err != nil {
+		log.Println("unable to load alert rules", err)
+		return
+	}
+	alerts.Start()
+	defer alerts.Close()
 
-	// broadcaster go routine that delays telemetry messages to clients
-	// so that telemetry can be synchronized with video.
-	go func() {
-		outgoingWebChannels := make([]chan []byte, 0, 100)
-		var syncedTimerChannel <-chan time.Time
-		var lastSyncedMessage SyncedMessage
-		for {
-			select {
-			case c := <-videoSyncedAddChannel:
-				log.Println("Adding videosynced client")
-				outgoingWebChannels = append(outgoingWebChannels, c)
-			case c := <-videoSyncedDelChannel:
-				log.Println("Removing videosynced client")
-				b := outgoingWebChannels[:0]
-				for _, x := range outgoingWebChannels {
-					if x != c {
-						b = append(b, x)
-					}
-				}
-				outgoingWebChannels = b
-			case lastSyncedMessage := <-videoSyncedSendChannel:
-				sendAt := lastSyncedMessage.QueuedTime.Add(videoDelay)
-				syncedTimerChannel = time.After(sendAt.Sub(time.Now()))
-			case <-syncedTimerChannel:
-				for c := range outgoingWebChannels {
-					select {
-					case outgoingWebChannels[c] <- lastSyncedMessage.Message:
-					default:
-					}
-				}
-			}
+	if rules, err := LoadStintRules(config.StintRulesFile); err == nil {
+		stintRules = rules
+	} else if os.IsNotExist(errors.Cause(err)) {
+		log.Println("no stint rules file found, using defaults:", config.StintRulesFile)
+	} else {
+		log.Println("unable to load stint rules", err)
+		return
+	}
+
+	recorder, err = NewRecorder(config.SessionDir)
+	if err != nil {
+		log.Println("unable to create session recorder", err)
+		return
+	}
+	recorder.Start()
+	defer recorder.Close()
+	if !replaying {
+		if err := RestoreSession(config.SessionDir); err != nil {
+			log.Println("unable to restore session", err)
 		}
-	}()
+	}
+
+	var replayer *Replayer
+	if *replayPath != "" {
+		replayer, err = NewReplayer(*replayPath)
+		if err != nil {
+			log.Println("unable to load replay", err)
+			return
+		}
+	} else {
+		udpServer, err := NewUDPIncoming()
+		if err != nil {
+			log.Println("unable to create UDP server", err)
+			return
+		}
+		if err := udpServer.Start(); err != nil {
+			log.Println("unable to start UDP server", err)
+			return
+		}
+		defer udpServer.Close()
+	}
 
 	// connect to timing server
 	timingTelemetry := make(chan telemetry.Timing)
 	go func() {
 		for {
 			tmpTelemetry := <-timingTelemetry
-			lock.Lock()
-			lastTimingTelemetry = tmpTelemetry
-			lock.Unlock()
-			msg, err := tmpTelemetry.JSONEncode()
-			if err == nil {
-				log.Println("SENDING TO CHANNEL")
-				sendChannel <- msg
-			} else {
+			recorder.Record(SourceTimingFeed, defaultCar.ID, tmpTelemetry)
+			if err := defaultCar.Publish(tmpTelemetry); err != nil {
 				log.Println("ERROR", err)
 			}
 		}
 	}()
-	//go startLapTimes(timingTelemetry)
+	if config.TimingAddr != "" {
+		source, err := NewTimingSource(config.TimingProtocol, config.TimingAddr, config.CarNumber)
+		if err != nil {
+			log.Println("unable to create timing source", err)
+			return
+		}
+		go startLapTimes(source, timingTelemetry)
+	}
+
+	if replayer != nil {
+		replayer.Start()
+		defer replayer.Close()
+	}
+
+	RegisterMetrics()
 
 	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	r.HandleFunc("/telemetry", TelemetryServer).Methods("GET")
-	r.HandleFunc("/ws/telemetry_in", WebSocketIncomingHandler)
-	r.HandleFunc("/ws/telemetry_out", func(w http.ResponseWriter, req *http.Request) {
-		channel := make(chan []byte, 3)
-		addChannel <- channel
-		WebSocketOutgoingHandler(w, req, channel)
-		delChannel <- channel
-	})
-	r.HandleFunc("/ws/telemetry_out/videosync", func(w http.ResponseWriter, req *http.Request) {
-		channel := make(chan []byte, 3)
-		videoSyncedAddChannel <- channel
-		WebSocketVideoSyncOutgoingHandler(w, req, channel)
-		videoSyncedDelChannel <- channel
-	})
+	r.HandleFunc("/telemetry/{car}", TelemetryServer).Methods("GET")
+	r.HandleFunc("/cars", CarsServer).Methods("GET")
+	r.HandleFunc("/track", TrackServer).Methods("GET")
+	r.HandleFunc("/laps", LapsServer).Methods("GET")
+	r.HandleFunc("/laps/{car}", LapsServer).Methods("GET")
+	r.HandleFunc("/laps/{car}/{lap}", LapsServer).Methods("GET")
+	r.HandleFunc("/pits", PitsServer).Methods("GET")
+	r.HandleFunc("/pits/{car}", PitsServer).Methods("GET")
+	r.HandleFunc("/stints", StintsServer).Methods("GET")
+	r.HandleFunc("/stints/driver", StintsServer).Methods("POST")
+	r.HandleFunc("/stints/{car}", StintsServer).Methods("GET")
+	r.HandleFunc("/stints/{car}/driver", StintsServer).Methods("POST")
+	r.HandleFunc("/link", LinkServer).Methods("GET")
+	r.HandleFunc("/link/{car}", LinkServer).Methods("GET")
+	r.HandleFunc("/clients", ClientsServer).Methods("GET")
+	r.HandleFunc("/videosync/delay", VideoDelayServer).Methods("GET", "POST")
+	calibration.RegisterHandlers(r)
+	r.HandleFunc("/session/new", NewSessionHandler).Methods("POST")
+	r.HandleFunc("/api/sessions", SessionsServer).Methods("GET")
+	r.HandleFunc("/api/sessions/{id}/telemetry", SessionTelemetryServer).Methods("GET")
+	r.HandleFunc("/api/sessions/{id}/export", SessionExportServer).Methods("GET")
+	r.HandleFunc("/uplink/auth", UplinkAuthStatsHandler).Methods("GET")
+	if replayer != nil {
+		replayer.RegisterHandlers(r)
+	} else {
+		r.HandleFunc("/ws/telemetry_in", WebSocketIncomingHandler)
+	}
+	outgoing := func(w http.ResponseWriter, req *http.Request) {
+		car, ok := requestCar(req)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		subscriber := car.hub.Subscribe(req.RemoteAddr)
+		WebSocketOutgoingHandler(w, req, car, subscriber.C)
+		car.hub.Unsubscribe(subscriber)
+	}
+	videoSyncOutgoing := func(w http.ResponseWriter, req *http.Request) {
+		car, ok := requestCar(req)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		// clients can ask for their own delay, otherwise they follow the
+		// default video delay
+		var delay time.Duration
+		if value := req.FormValue("delay"); value != "" {
+			var err error
+			if delay, err = parseVideoDelay(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		client := car.videoSync.Subscribe(req.RemoteAddr, delay)
+		WebSocketVideoSyncOutgoingHandler(w, req, client)
+		car.videoSync.Unsubscribe(client)
+	}
+	r.HandleFunc("/ws/telemetry_out", outgoing)
+	r.HandleFunc("/ws/telemetry_out/videosync", videoSyncOutgoing)
+	r.HandleFunc("/ws/telemetry_out/{car}", outgoing)
+	r.HandleFunc("/ws/telemetry_out/{car}/videosync", videoSyncOutgoing)
 	RegisterSiteHandlers(r)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(config.StaticDir))))
 	http.Handle("/", r)
 
+	var servers []*http.Server
+	if config.TLS() {
+		certs, err := NewCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			log.Println("unable to load TLS certificate", err)
+			return
+		}
+		certs.Start()
+		defer certs.Close()
+
+		servers = append(servers, &http.Server{
+			Addr:      config.HTTPSAddr,
+			TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate},
+		})
+	}
+	if config.HTTPAddr != "" {
+		server := &http.Server{Addr: config.HTTPAddr}
+		if config.RedirectHTTP {
+			server.Handler = RedirectToHTTPS(http.DefaultServeMux)
+		}
+		servers = append(servers, server)
+	}
+
+	// shut down cleanly so that clients are disconnected and the session
+	// log is flushed
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-shutdown
+		log.Println("shutting down")
+		CloseCars()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			server.Shutdown(ctx)
+		}
+	}()
 
-	if err := http.ListenAndServe(":80", nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	// every server stops once one has failed or they have been shut down
+	var wg sync.WaitGroup
+	var serveErr error
+	var serveErrOnce sync.Once
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			var err error
+			if server.TLSConfig != nil {
+				log.Println("serving HTTPS on", server.Addr)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Println("serving HTTP on", server.Addr)
+				err = server.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				serveErrOnce.Do(func() {
+					serveErr = err
+					select {
+					case shutdown <- syscall.SIGTERM:
+					default:
+					}
+				})
+			}
+		}(server)
+	}
+	wg.Wait()
+	if serveErr != nil {
+		log.Fatal("ListenAndServe: ", serveErr)
 	}
 }
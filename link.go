@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how often the link status is sent to dashboards
+const linkStatusInterval = time.Second
+
+// weight given to each frame in the recent loss rate, and to each frame's
+// change in transit time in the jitter, as RTP does (RFC 3550)
+const (
+	linkLossWeight    = 1.0 / 64
+	linkJitterWeight  = 1.0 / 16
+	linkLatencyWeight = 1.0 / 16
+)
+
+// a sequence number this far from the last is the car restarting, not lost
+// or late frames
+const linkSequenceRestart = 1000
+
+// frames before the last that are remembered as missing, a frame arriving
+// later than this stays counted as lost
+const linkMissingWindow = 64
+
+type linkSource struct {
+	status  telemetry.LinkSourceStatus
+	lastSeq uint32
+	// bit i is set while frame lastSeq-1-i is missing, so a late frame is
+	// only taken off Lost once however many copies of it arrive
+	missing uint64
+	// time from the car's clock to ours for the last frame with a
+	// timestamp, includes any difference between the clocks
+	lastTransit time.Duration
+	haveTransit bool
+}
+
+// returns how many frames after from the car sent to, negative if before.
+// The difference is signed so the sequence can wrap, which skips zero as a
+// zero sequence number isn't sent.
+func sequenceGap(from, to uint32) int32 {
+	gap := int32(to - from)
+	if gap > 0 && to < from {
+		gap--
+	} else if gap < 0 && to > from {
+		gap++
+	}
+	return gap
+}
+
+// updates the recent loss rate for the next expected frame
+func (s *linkSource) expected(lost bool) {
+	x := 0.0
+	if lost {
+		x = 1
+	}
+	s.status.LossRate += linkLossWeight * (x - s.status.LossRate)
+}
+
+// LinkMonitor measures the health of the uplink from a car over each source
+// frames arrive on. Latency is only meaningful when the car's clock is set,
+// e.g. from GPS.
+type LinkMonitor struct {
+	mu           sync.Mutex
+	sources      map[string]*linkSource
+	lastReceived time.Time
+	stale        bool
+	primary      string
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewLinkMonitor() *LinkMonitor {
+	// nothing has been received yet
+	return &LinkMonitor{sources: make(map[string]*linkSource), stale: true}
+}
+
+// Received records a frame that arrived from source at the given time
+func (m *LinkMonitor) Received(source string, env telemetry.Envelope, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sources[source]
+	if !ok {
+		s = &linkSource{status: telemetry.LinkSourceStatus{Source: source}}
+		m.sources[source] = s
+	}
+	s.status.Received++
+	s.status.LastReceived = at
+
+	if env.Sequence != 0 {
+		gap := sequenceGap(s.lastSeq, env.Sequence)
+		switch {
+		case s.lastSeq == 0 || gap >= linkSequenceRestart || gap <= -linkSequenceRestart:
+			s.lastSeq = env.Sequence
+			s.missing = 0
+			s.expected(false)
+		case gap > 0:
+			for i := int32(1); i < gap; i++ {
+				s.expected(true)
+			}
+			s.status.Lost += uint64(gap - 1)
+			s.expected(false)
+			s.lastSeq = env.Sequence
+			// shifts of the window's width or more clear it
+			s.missing = s.missing<<uint(gap) | (uint64(1)<<uint(gap-1) - 1)
+		case gap < 0 && -gap <= linkMissingWindow:
+			bit := uint64(1) << uint(-gap-1)
+			if s.missing&bit != 0 {
+				// arrived out of order, it was counted as lost
+				s.missing &^= bit
+				s.status.Lost--
+			}
+		}
+	}
+
+	if !env.Time.IsZero() {
+		transit := at.Sub(env.Time)
+		latency := float64(transit) / float64(time.Millisecond)
+		if s.haveTransit {
+			change := math.Abs(float64(transit-s.lastTransit) / float64(time.Millisecond))
+			s.status.Jitter += linkJitterWeight * (change - s.status.Jitter)
+			s.status.Latency += linkLatencyWeight * (latency - s.status.Latency)
+		} else {
+			s.status.Latency = latency
+		}
+		s.lastTransit = transit
+		s.haveTransit = true
+	}
+}
+
+// Used records that a frame from source that arrived at the given time was
+// decoded and passed on, as it arrived before any copy of it over another
+// source. The car's telemetry is only fresh while frames are being used.
+func (m *LinkMonitor) Used(source string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sources[source]; ok {
+		s.status.Used++
+	}
+	m.primary = source
+	if at.After(m.lastReceived) {
+		m.lastReceived = at
+	}
+}
+
+// Undecodable records that a frame from source arrived but couldn't be
+// decoded
+func (m *LinkMonitor) Undecodable(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sources[source]; ok {
+		s.status.Undecodable++
+	}
+}
+
+// Status returns the health of each source
+func (m *LinkMonitor) Status(now time.Time) telemetry.LinkStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	timeout := time.Duration(config.StaleTimeout)
+	status := telemetry.LinkStatus{
+		Stale:   m.lastReceived.IsZero() || now.Sub(m.lastReceived) > timeout,
+		Primary: m.primary,
+		Sources: []telemetry.LinkSourceStatus{},
+	}
+	if !m.lastReceived.IsZero() {
+		lastReceived := m.lastReceived
+		status.LastReceived = &lastReceived
+	}
+	for _, s := range m.sources {
+		source := s.status
+		source.Stale = now.Sub(source.LastReceived) > timeout
+		status.Sources = append(status.Sources, source)
+	}
+	sort.Slice(status.Sources, func(i, j int) bool {
+		return status.Sources[i].Source < status.Sources[j].Source
+	})
+	return status
+}
+
+// starts sending the link status to the car's dashboards every
+// linkStatusInterval
+func (m *LinkMonitor) Start(car *Car) {
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(linkStatusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				status := m.Status(now)
+				m.logChange(car, status)
+
+				b, err := status.JSONEncode()
+				if err != nil {
+					log.Println("cannot JSON encode link status", err)
+					continue
+				}
+				car.hub.Send(b)
+			}
+		}
+	}()
+}
+
+// logs when the car's telemetry goes stale or starts arriving again
+func (m *LinkMonitor) logChange(car *Car, status telemetry.LinkStatus) {
+	m.mu.Lock()
+	changed := status.Stale != m.stale
+	m.stale = status.Stale
+	m.mu.Unlock()
+	if !changed {
+		return
+	}
+	if status.Stale {
+		log.Println("car", car.ID, "telemetry is stale, nothing received for", time.Duration(config.StaleTimeout))
+	} else {
+		log.Println("car", car.ID, "telemetry is being received")
+	}
+}
+
+func (m *LinkMonitor) Close() {
+	if m.stop != nil {
+		close(m.stop)
+		m.wg.Wait()
+		m.stop = nil
+	}
+}
+
+// HTTP request handler for the health of a car's uplink
+//
+//	GET /link/{car}
+func LinkServer(w http.ResponseWriter, req *http.Request) {
+	car, ok := requestCar(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	b, err := json.Marshal(car.link.Status(time.Now()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
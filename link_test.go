@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"testing"
+	"time"
+)
+
+func TestLinkMonitorLost(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences []uint32
+		lost      uint64
+	}{
+		{"in order", []uint32{1, 2, 3, 4}, 0},
+		{"missing", []uint32{1, 2, 5, 6}, 2},
+		{"late", []uint32{1, 3, 4, 2}, 0},
+		// a copy of a late frame is only taken off once
+		{"late copies", []uint32{1, 4, 2, 2, 3, 3}, 0},
+		{"later than the window", []uint32{1, 2, 100, 3}, 97},
+		{"wrap", []uint32{0xfffffffe, 0xffffffff, 1, 2}, 0},
+		{"missing across the wrap", []uint32{0xfffffffe, 2}, 2},
+		{"late across the wrap", []uint32{0xfffffffe, 1, 0xffffffff}, 0},
+		{"restart", []uint32{5000, 5001, 1, 2}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewLinkMonitor()
+			now := time.Now()
+			for _, sequence := range test.sequences {
+				m.Received(SourceUDP, telemetry.Envelope{Sequence: sequence}, now)
+			}
+			if lost := m.Status(now).Sources[0].Lost; lost != test.lost {
+				t.Errorf("lost %d, want %d", lost, test.lost)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// how long a frame is held waiting for the frames before it, which may be
+// on their way over another modem
+const mergeReorderWindow = 100 * time.Millisecond
+
+type pendingFrame struct {
+	frame   []byte
+	source  string
+	arrived time.Time
+}
+
+// FrameMerger combines the frames a car sends over more than one source,
+// e.g. UDP and websocket over two modems. Frames are passed on in sequence
+// order, each once, whichever source it arrived on first. A missing frame
+// is waited for at most mergeReorderWindow before it is given up on. Frames
+// without a sequence number are passed straight on.
+type FrameMerger struct {
+	deliver func(frame []byte, source string) error
+	used    func(source string, at time.Time)
+	// the clock frames are given up on by, replaced in tests
+	now func() time.Time
+
+	// held while frames are delivered so that they are delivered in order
+	mu sync.Mutex
+	// the sequence number of the next frame to deliver, zero before the
+	// first frame
+	next    uint32
+	pending map[uint32]pendingFrame
+	timer   *time.Timer
+	// set by Close, after which nothing more is delivered
+	closed bool
+}
+
+// NewFrameMerger returns a merger passing frames to deliver, and calling
+// used with the source and arrival time of each frame that deliver accepts
+func NewFrameMerger(deliver func(frame []byte, source string) error, used func(source string, at time.Time)) *FrameMerger {
+	return &FrameMerger{
+		deliver: deliver,
+		used:    used,
+		now:     time.Now,
+		pending: make(map[uint32]pendingFrame),
+	}
+}
+
+// Add takes a frame that arrived from source with the sequence number from
+// its envelope
+func (m *FrameMerger) Add(sequence uint32, frame []byte, source string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+
+	if sequence == 0 {
+		m.send(pendingFrame{frame, source, at})
+		return
+	}
+
+	// the difference is signed so the sequence can wrap
+	ahead := int32(sequence - m.next)
+	if m.next == 0 || ahead >= linkSequenceRestart || ahead <= -linkSequenceRestart {
+		// the first frame, or the car restarted
+		m.flush()
+		m.next = sequence
+	} else if ahead < 0 {
+		// a duplicate of a frame already delivered, or one that was given up on
+		return
+	}
+	if _, ok := m.pending[sequence]; ok {
+		return
+	}
+
+	// copy as the source reuses its buffer
+	m.pending[sequence] = pendingFrame{append([]byte(nil), frame...), source, at}
+	m.release()
+	if len(m.pending) > 0 && m.timer == nil {
+		m.timer = time.AfterFunc(mergeReorderWindow, m.expire)
+	}
+}
+
+// delivers the frames that are next in sequence
+func (m *FrameMerger) release() {
+	for {
+		p, ok := m.pending[m.next]
+		if !ok {
+			return
+		}
+		delete(m.pending, m.next)
+		m.next++
+		if m.next == 0 {
+			// the car doesn't send sequence number zero, it wraps to one
+			m.next = 1
+		}
+		m.send(p)
+	}
+}
+
+// gives up on missing frames that have been waited for long enough
+func (m *FrameMerger) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		// fired before Close could stop it
+		return
+	}
+	m.timer = nil
+
+	for len(m.pending) > 0 {
+		oldest, first := m.oldest()
+		wait := mergeReorderWindow - m.now().Sub(m.pending[oldest].arrived)
+		if wait > 0 {
+			m.timer = time.AfterFunc(wait, m.expire)
+			return
+		}
+		m.next = first
+		m.release()
+	}
+}
+
+// returns the sequence number of the frame that has been waiting longest,
+// and of the lowest pending frame
+func (m *FrameMerger) oldest() (oldest uint32, first uint32) {
+	found := false
+	for sequence, p := range m.pending {
+		if !found || p.arrived.Before(m.pending[oldest].arrived) {
+			oldest = sequence
+		}
+		if !found || int32(sequence-first) < 0 {
+			first = sequence
+		}
+		found = true
+	}
+	return oldest, first
+}
+
+// delivers every pending frame in order
+func (m *FrameMerger) flush() {
+	for len(m.pending) > 0 {
+		_, m.next = m.oldest()
+		m.release()
+	}
+}
+
+func (m *FrameMerger) send(p pendingFrame) {
+	if err := m.deliver(p.frame, p.source); err != nil {
+		log.Println("unable to process", p.source, "frame:", err)
+		return
+	}
+	m.used(p.source, p.arrived)
+}
+
+// Close stops waiting for missing frames and delivers the frames held
+func (m *FrameMerger) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.flush()
+	m.closed = true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mergeArrival struct {
+	sequence uint32
+	source   string
+	// the clock moves on this far before the frame arrives
+	after time.Duration
+}
+
+func TestFrameMerger(t *testing.T) {
+	tests := []struct {
+		name     string
+		arrivals []mergeArrival
+		// sequence numbers and sources of the frames delivered, in order
+		want        []uint32
+		wantSources []string
+	}{
+		{
+			name: "duplicates across sources",
+			arrivals: []mergeArrival{
+				{1, SourceUDP, 0}, {1, SourceWebSocket, 0},
+				{2, SourceWebSocket, 0}, {2, SourceUDP, 0},
+				{3, SourceUDP, 0}, {3, SourceUDP, 0},
+			},
+			want:        []uint32{1, 2, 3},
+			wantSources: []string{SourceUDP, SourceWebSocket, SourceUDP},
+		},
+		{
+			name: "gap filled within the window",
+			arrivals: []mergeArrival{
+				{1, SourceUDP, 0}, {3, SourceUDP, 0}, {4, SourceUDP, 0},
+				{2, SourceWebSocket, mergeReorderWindow / 4},
+			},
+			want:        []uint32{1, 2, 3, 4},
+			wantSources: []string{SourceUDP, SourceWebSocket, SourceUDP, SourceUDP},
+		},
+		{
+			name: "gap expires",
+			arrivals: []mergeArrival{
+				{1, SourceUDP, 0}, {3, SourceUDP, 0},
+				// too late, 3 has been delivered
+				{2, SourceWebSocket, 3 * mergeReorderWindow},
+				{4, SourceUDP, 0},
+			},
+			want:        []uint32{1, 3, 4},
+			wantSources: []string{SourceUDP, SourceUDP, SourceUDP},
+		},
+		{
+			name: "sequence wraps",
+			arrivals: []mergeArrival{
+				{0xfffffffe, SourceUDP, 0}, {0xffffffff, SourceUDP, 0},
+				{2, SourceUDP, 0}, {1, SourceWebSocket, 0},
+			},
+			want:        []uint32{0xfffffffe, 0xffffffff, 1, 2},
+			wantSources: []string{SourceUDP, SourceUDP, SourceWebSocket, SourceUDP},
+		},
+		{
+			name: "car restarts",
+			arrivals: []mergeArrival{
+				{5000, SourceUDP, 0}, {5001, SourceUDP, 0},
+				{1, SourceUDP, 0}, {2, SourceUDP, 0},
+			},
+			want:        []uint32{5000, 5001, 1, 2},
+			wantSources: []string{SourceUDP, SourceUDP, SourceUDP, SourceUDP},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make(chan uint32, 100)
+			gotSources := make(chan string, 100)
+			m := NewFrameMerger(func(frame []byte, source string) error {
+				got <- uint32(frame[0]) | uint32(frame[1])<<8 | uint32(frame[2])<<16 | uint32(frame[3])<<24
+				return nil
+			}, func(source string, at time.Time) {
+				gotSources <- source
+			})
+			defer m.Close()
+			var mu sync.Mutex
+			now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+			m.now = func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			for _, a := range test.arrivals {
+				if a.after > 0 {
+					mu.Lock()
+					now = now.Add(a.after)
+					mu.Unlock()
+					// as the timer would
+					m.expire()
+				}
+				frame := []byte{byte(a.sequence), byte(a.sequence >> 8), byte(a.sequence >> 16), byte(a.sequence >> 24)}
+				m.Add(a.sequence, frame, a.source, m.now())
+			}
+
+			// every frame is delivered without waiting for Close
+			var sequences []uint32
+			var sources []string
+			for len(got) > 0 {
+				sequences = append(sequences, <-got)
+				sources = append(sources, <-gotSources)
+			}
+			if !reflect.DeepEqual(sequences, test.want) {
+				t.Errorf("delivered %v, want %v", sequences, test.want)
+			}
+			if !reflect.DeepEqual(sources, test.wantSources) {
+				t.Errorf("used %v, want %v", sources, test.wantSources)
+			}
+		})
+	}
+}
+
+func TestFrameMergerClosed(t *testing.T) {
+	delivered := 0
+	m := NewFrameMerger(func(frame []byte, source string) error {
+		delivered++
+		return nil
+	}, func(string, time.Time) {})
+	m.Add(1, []byte{1}, SourceUDP, time.Now())
+	m.Add(3, []byte{3}, SourceUDP, time.Now())
+	m.Close()
+	// a timer that fired before Close stopped it, or a late frame
+	m.expire()
+	m.Add(4, []byte{4}, SourceUDP, time.Now())
+	if delivered != 2 {
+		t.Errorf("delivered %d frames, want 2", delivered)
+	}
+}
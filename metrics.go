@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Prometheus metrics served on /metrics. Most are read from the cars when
+// scraped rather than being updated as frames arrive.
+
+// reasons a received frame couldn't be used
+const (
+	decodeErrorEnvelope  = "envelope"
+	decodeErrorCar       = "car"
+	decodeErrorVersion   = "version"
+	decodeErrorLayout    = "layout"
+	decodeErrorTruncated = "truncated"
+	decodeErrorFrame     = "frame"
+)
+
+// returns the reason a frame couldn't be decoded
+func decodeErrorReason(err error) string {
+	switch errors.Cause(err) {
+	case telemetry.ErrUnknownVersion:
+		return decodeErrorVersion
+	case telemetry.ErrLayoutMismatch:
+		return decodeErrorLayout
+	case telemetry.ErrTruncated:
+		return decodeErrorTruncated
+	}
+	return decodeErrorFrame
+}
+
+var decodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "lemonaid_decode_errors_total",
+	Help: "Received frames that couldn't be decoded, by reason.",
+}, []string{"reason"})
+
+var (
+	framesReceivedDesc = prometheus.NewDesc("lemonaid_frames_received_total",
+		"Frames received from a car, by transport.", []string{"car", "transport"}, nil)
+	framesUsedDesc = prometheus.NewDesc("lemonaid_frames_used_total",
+		"Frames used from a transport, the rest were copies already received over another.", []string{"car", "transport"}, nil)
+	framesLostDesc = prometheus.NewDesc("lemonaid_frames_lost_total",
+		"Frames from a car missing from the sequence, by transport.", []string{"car", "transport"}, nil)
+	uplinkRejectedDesc = prometheus.NewDesc("lemonaid_uplink_rejected_total",
+		"Uplink frames and connections rejected by authentication.", []string{"transport"}, nil)
+	lastFrameAgeDesc = prometheus.NewDesc("lemonaid_last_telemetry_age_seconds",
+		"Time since telemetry was last received from a car.", []string{"car"}, nil)
+	liveClientsDesc = prometheus.NewDesc("lemonaid_live_clients",
+		"Dashboards connected to a car's live stream.", []string{"car"}, nil)
+	videoSyncClientsDesc = prometheus.NewDesc("lemonaid_videosync_clients",
+		"Dashboards connected to a car's videosync stream.", []string{"car"}, nil)
+	videoSyncQueueDesc = prometheus.NewDesc("lemonaid_videosync_queue_messages",
+		"Messages held for videosync clients to play back.", []string{"car"}, nil)
+	droppedDesc = prometheus.NewDesc("lemonaid_broadcast_dropped_total",
+		"Messages dropped by a car's broadcasters, by the hub itself, for slow subscribers or for slow videosync clients.", []string{"car", "stage"}, nil)
+	telemetryDesc = prometheus.NewDesc("lemonaid_telemetry",
+		"Latest value of each numeric telemetry field.", []string{"car", "field"}, nil)
+)
+
+// reads the metrics from every car when scraped
+type carCollector struct{}
+
+func (carCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		framesReceivedDesc, framesUsedDesc, framesLostDesc, uplinkRejectedDesc,
+		lastFrameAgeDesc, liveClientsDesc, videoSyncClientsDesc, videoSyncQueueDesc,
+		droppedDesc, telemetryDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (carCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	if uplinkAuth != nil {
+		stats := uplinkAuth.Stats()
+		ch <- prometheus.MustNewConstMetric(uplinkRejectedDesc, prometheus.CounterValue, float64(stats.UDPRejected), SourceUDP)
+		ch <- prometheus.MustNewConstMetric(uplinkRejectedDesc, prometheus.CounterValue, float64(stats.WebSocketRejected), SourceWebSocket)
+	}
+
+	for _, id := range CarIDs() {
+		car, ok := LookupCar(id)
+		if !ok {
+			continue
+		}
+
+		for _, source := range car.link.Status(now).Sources {
+			ch <- prometheus.MustNewConstMetric(framesReceivedDesc, prometheus.CounterValue, float64(source.Received), id, source.Source)
+			ch <- prometheus.MustNewConstMetric(framesUsedDesc, prometheus.CounterValue, float64(source.Used), id, source.Source)
+			ch <- prometheus.MustNewConstMetric(framesLostDesc, prometheus.CounterValue, float64(source.Lost), id, source.Source)
+		}
+
+		ch <- prometheus.MustNewConstMetric(liveClientsDesc, prometheus.GaugeValue, float64(len(car.hub.Subscribers())), id)
+		ch <- prometheus.MustNewConstMetric(videoSyncClientsDesc, prometheus.GaugeValue, float64(len(car.videoSync.Clients())), id)
+		ch <- prometheus.MustNewConstMetric(videoSyncQueueDesc, prometheus.GaugeValue, float64(car.videoSync.Len()), id)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(car.hub.Dropped()), id, "hub")
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(car.hub.SubscriberDropped()), id, "subscriber")
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(car.videoSync.Dropped()), id, "videosync")
+
+		car.lock.RLock()
+		received := car.lastTelemetryTime
+		latest := *car.lastTelemetry.Telemetry
+		car.lock.RUnlock()
+		// the values a car starts with are placeholders
+		if received.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(lastFrameAgeDesc, prometheus.GaugeValue, now.Sub(received).Seconds(), id)
+		for _, field := range telemetryFieldNames() {
+			value, err := telemetryFieldValue(&latest, field)
+			if err != nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(telemetryDesc, prometheus.GaugeValue, value, id, field)
+		}
+	}
+}
+
+// RegisterMetrics adds the server's metrics to the default Prometheus
+// registry
+func RegisterMetrics() {
+	prometheus.MustRegister(decodeErrors, carCollector{})
+	// start every reason at zero so rates can be graphed before the first
+	// error
+	for _, reason := range []string{decodeErrorEnvelope, decodeErrorCar, decodeErrorVersion, decodeErrorLayout, decodeErrorTruncated, decodeErrorFrame} {
+		decodeErrors.WithLabelValues(reason)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// A minimal Parquet writer for flat tables of doubles, enough for session
+// exports to be loaded by pandas, Spark and friends. Values are written
+// uncompressed with the PLAIN encoding, a row group at a time so that only
+// one row group is held in memory, and the file metadata is encoded with the
+// Thrift compact protocol by hand.
+//
+// See https://github.com/apache/parquet-format for the format.
+
+// rows written in each data page
+const parquetPageRows = 10000
+
+// rows held in memory and written as each row group
+const parquetRowGroupRows = 100000
+
+const parquetMagic = "PAR1"
+
+// enum values from parquet.thrift
+const (
+	parquetTypeDouble    = 5
+	parquetRequired      = 0
+	parquetOptional      = 1
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetUncompressed  = 0
+	parquetPageTypeData  = 0
+)
+
+// definition level of a value in an optional column that isn't null
+const parquetDefined = 1
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// a column of a Parquet table, NaN values of an optional column are null
+type parquetColumn struct {
+	Name     string
+	Optional bool
+}
+
+// writes fields using the Thrift compact protocol
+type thriftWriter struct {
+	buf bytes.Buffer
+	// id of the last field written in each open struct
+	lastField []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.lastField[len(t.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+func (t *thriftWriter) list(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+// starts a struct, the field header is written unless the struct is a
+// list element
+func (t *thriftWriter) beginStruct(id int16) {
+	if id > 0 {
+		t.field(id, thriftStruct)
+	}
+	t.lastField = append(t.lastField, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.lastField = t.lastField[:len(t.lastField)-1]
+}
+
+// tracks the offset into the file for the metadata
+type countingWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// where a column was written, for the file metadata
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+// encodes definition levels as RLE runs, prefixed with their length
+func parquetDefinitionLevels(values []float64) []byte {
+	var runs bytes.Buffer
+	var b [binary.MaxVarintLen64]byte
+	for i := 0; i < len(values); {
+		null := math.IsNaN(values[i])
+		run := 1
+		for i+run < len(values) && math.IsNaN(values[i+run]) == null {
+			run++
+		}
+		runs.Write(b[:binary.PutUvarint(b[:], uint64(run)<<1)])
+		if null {
+			runs.WriteByte(0)
+		} else {
+			runs.WriteByte(parquetDefined)
+		}
+		i += run
+	}
+
+	levels := make([]byte, 4, 4+runs.Len())
+	binary.LittleEndian.PutUint32(levels, uint32(runs.Len()))
+	return append(levels, runs.Bytes()...)
+}
+
+func writeParquetPage(w io.Writer, column parquetColumn, values []float64) error {
+	var page bytes.Buffer
+	if column.Optional {
+		page.Write(parquetDefinitionLevels(values))
+	}
+	var b [8]byte
+	for _, value := range values {
+		if column.Optional && math.IsNaN(value) {
+			continue
+		}
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		page.Write(b[:])
+	}
+
+	header := &thriftWriter{lastField: []int16{0}}
+	header.i32(1, parquetPageTypeData)
+	header.i32(2, int32(page.Len()))
+	header.i32(3, int32(page.Len()))
+	header.beginStruct(5)
+	header.i32(1, int32(len(values)))
+	header.i32(2, parquetEncodingPlain)
+	header.i32(3, parquetEncodingRLE)
+	header.i32(4, parquetEncodingRLE)
+	header.endStruct()
+	header.buf.WriteByte(0)
+
+	if _, err := w.Write(header.buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(page.Bytes())
+	return err
+}
+
+// a row group that has been written, for the file metadata
+type parquetRowGroup struct {
+	rows   int
+	chunks []parquetChunk
+}
+
+// parquetWriter writes a Parquet file a row group at a time
+type parquetWriter struct {
+	w         *countingWriter
+	columns   []parquetColumn
+	rowGroups []parquetRowGroup
+}
+
+// newParquetWriter starts a file with the given columns, their values are
+// passed to WriteRowGroup
+func newParquetWriter(out io.Writer, columns []parquetColumn) (*parquetWriter, error) {
+	w := &countingWriter{w: out}
+	if _, err := io.WriteString(w, parquetMagic); err != nil {
+		return nil, err
+	}
+	return &parquetWriter{w: w, columns: columns}, nil
+}
+
+// WriteRowGroup writes the values of each column, in the order the columns
+// were given, every column must have the same number of values
+func (p *parquetWriter) WriteRowGroup(values [][]float64) error {
+	var group parquetRowGroup
+	if len(values) > 0 {
+		group.rows = len(values[0])
+	}
+	if group.rows == 0 {
+		return nil
+	}
+
+	group.chunks = make([]parquetChunk, len(p.columns))
+	for i, column := range p.columns {
+		group.chunks[i].offset = p.w.offset
+		for start := 0; start < group.rows; start += parquetPageRows {
+			end := start + parquetPageRows
+			if end > group.rows {
+				end = group.rows
+			}
+			if err := writeParquetPage(p.w, column, values[i][start:end]); err != nil {
+				return err
+			}
+		}
+		group.chunks[i].size = p.w.offset - group.chunks[i].offset
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	return nil
+}
+
+// Close writes the file metadata, it doesn't close the underlying writer
+func (p *parquetWriter) Close() error {
+	var rows int
+	for _, group := range p.rowGroups {
+		rows += group.rows
+	}
+
+	meta := &thriftWriter{lastField: []int16{0}}
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(p.columns)+1)
+	meta.beginStruct(0)
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(p.columns)))
+	meta.endStruct()
+	for _, column := range p.columns {
+		meta.beginStruct(0)
+		meta.i32(1, parquetTypeDouble)
+		if column.Optional {
+			meta.i32(3, parquetOptional)
+		} else {
+			meta.i32(3, parquetRequired)
+		}
+		meta.binary(4, column.Name)
+		meta.endStruct()
+	}
+	meta.i64(3, int64(rows))
+
+	meta.list(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		var totalSize int64
+		for _, chunk := range group.chunks {
+			totalSize += chunk.size
+		}
+
+		meta.beginStruct(0)
+		meta.list(1, thriftStruct, len(p.columns))
+		for i, column := range p.columns {
+			chunk := group.chunks[i]
+			meta.beginStruct(0)
+			meta.i64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.i32(1, parquetTypeDouble)
+			meta.list(2, thriftI32, 2)
+			meta.zigzag(parquetEncodingPlain)
+			meta.zigzag(parquetEncodingRLE)
+			meta.list(3, thriftBinary, 1)
+			meta.varint(uint64(len(column.Name)))
+			meta.buf.WriteString(column.Name)
+			meta.i32(4, parquetUncompressed)
+			meta.i64(5, int64(group.rows))
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.i64(2, totalSize)
+		meta.i64(3, int64(group.rows))
+		meta.endStruct()
+	}
+
+	meta.binary(6, "lemonaid")
+	meta.buf.WriteByte(0)
+
+	if _, err := p.w.Write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(meta.buf.Len()))
+	if _, err := p.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(p.w, parquetMagic)
+	return err
+}
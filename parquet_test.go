@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"math"
+	"testing"
+	"time"
+)
+
+// reads every column of a Parquet file with an independent reader, nulls
+// are returned as NaN
+func readParquet(t *testing.T, b []byte) (names []string, columns [][]float64) {
+	t.Helper()
+	r, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(b), 1)
+	if err != nil {
+		t.Fatal("unable to read parquet:", err)
+	}
+	defer r.ReadStop()
+
+	rows := r.GetNumRows()
+	for i, element := range r.Footer.Schema[1:] {
+		names = append(names, element.Name)
+		values, _, _, err := r.ReadColumnByIndex(int64(i), rows)
+		if err != nil {
+			t.Fatalf("unable to read column %s: %v", element.Name, err)
+		}
+		column := make([]float64, len(values))
+		for j, value := range values {
+			if value == nil {
+				column[j] = math.NaN()
+			} else {
+				column[j] = value.(float64)
+			}
+		}
+		columns = append(columns, column)
+	}
+	return names, columns
+}
+
+func sameFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	// long enough for more than one page, with runs of nulls of every
+	// length, over two row groups
+	rows := parquetPageRows + 123
+	times := make([]float64, rows)
+	rpm := make([]float64, rows)
+	empty := make([]float64, rows)
+	for i := range times {
+		times[i] = float64(i) / 10
+		rpm[i] = float64(i % 9000)
+		if i%7 < i%5 {
+			rpm[i] = math.NaN()
+		}
+		empty[i] = math.NaN()
+	}
+	columns := []parquetColumn{
+		{Name: "Time"},
+		{Name: "RPM", Optional: true},
+		{Name: "Empty", Optional: true},
+	}
+	want := [][]float64{times, rpm, empty}
+
+	var buf bytes.Buffer
+	p, err := newParquetWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := rows / 3
+	for _, group := range [][2]int{{0, split}, {split, rows}} {
+		values := make([][]float64, len(want))
+		for i := range want {
+			values[i] = want[i][group[0]:group[1]]
+		}
+		if err := p.WriteRowGroup(values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, values := readParquet(t, buf.Bytes())
+	if len(names) != len(columns) {
+		t.Fatalf("read %d columns, want %d", len(names), len(columns))
+	}
+	for i, column := range columns {
+		if names[i] != column.Name {
+			t.Errorf("column %d is %s, want %s", i, names[i], column.Name)
+		}
+		if !sameFloats(values[i], want[i]) {
+			t.Errorf("column %s values differ", column.Name)
+		}
+	}
+}
+
+func TestExportParquetRowGroups(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Time: start, Telemetry: &telemetry.Telemetry{RPM: 1000}},
+		{Time: start.Add(time.Hour), Telemetry: &telemetry.Telemetry{RPM: 2000}},
+		{Time: start.Add(3 * time.Hour), Telemetry: &telemetry.Telemetry{RPM: 3000}},
+	}
+	scan := func(fn func(rec Record) error) error {
+		for _, rec := range records {
+			if err := fn(rec); err == errStopScan {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	channels, err := ParseExportChannels("RPM,BestLap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more rows than fit in one row group
+	table, err := buildExportTable(scan, ExportOptions{Car: defaultCarID, Channels: channels, Rate: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3*60*60*10 + 1; table.Rows != want || table.Rows <= parquetRowGroupRows {
+		t.Fatalf("%d rows, want %d", table.Rows, want)
+	}
+
+	var buf bytes.Buffer
+	if err := writeExportParquet(&buf, table); err != nil {
+		t.Fatal(err)
+	}
+	names, values := readParquet(t, buf.Bytes())
+	if len(names) != 3 || names[0] != "Time" || names[1] != "RPM" || names[2] != "BestLap" {
+		t.Fatalf("columns %v", names)
+	}
+	for _, row := range []int{0, 36000 - 1, 36000, 108000 - 1, 108000} {
+		wantRPM := 1000.0
+		if row >= 108000 {
+			wantRPM = 3000
+		} else if row >= 36000 {
+			wantRPM = 2000
+		}
+		if values[0][row] != float64(row)/10 || values[1][row] != wantRPM || !math.IsNaN(values[2][row]) {
+			t.Errorf("row %d is %v, %v, %v", row, values[0][row], values[1][row], values[2][row])
+		}
+	}
+	if len(values[0]) != table.Rows {
+		t.Errorf("read %d rows, want %d", len(values[0]), table.Rows)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the car is stopped below this speed, in mph
+const pitStoppedSpeed = 3
+
+// the engine is off below this RPM
+const pitEngineOffRPM = 200
+
+// the car must be on the other side of the pit lane boundary for this long
+// before it has entered or left, so GPS jitter at the pit entry and exit
+// doesn't split a stop in two
+const pitLaneDebounce = 2 * time.Second
+
+// pit stops kept for each car
+const maxPitStops = 100
+
+// GPSPolygon is an area such as the pit lane, the points are its corners in
+// order around the edge
+type GPSPolygon []GPSPoint
+
+// ParseGPSPolygon parses "lat,lon;lat,lon;lat,lon..."
+func ParseGPSPolygon(value string) (GPSPolygon, error) {
+	var polygon GPSPolygon
+	for _, corner := range strings.Split(value, ";") {
+		parts := strings.Split(corner, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("corner %q must be lat,lon", corner)
+		}
+		var coords [2]float64
+		for i, part := range parts {
+			var err error
+			coords[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid coordinate %q", part)
+			}
+		}
+		polygon = append(polygon, GPSPoint{coords[0], coords[1]})
+	}
+	if len(polygon) < 3 {
+		return nil, fmt.Errorf("polygon %q needs at least 3 corners", value)
+	}
+	return polygon, nil
+}
+
+// Contains reports whether the point is inside the polygon. Over an area the
+// size of a pit lane latitude and longitude can be treated as flat.
+func (p GPSPolygon) Contains(point GPSPoint) bool {
+	inside := false
+	for i, j := 0, len(p)-1; i < len(p); j, i = i, i+1 {
+		a, b := p[i], p[j]
+		if (a.Latitude > point.Latitude) != (b.Latitude > point.Latitude) {
+			crossing := a.Longitude + (point.Latitude-a.Latitude)/(b.Latitude-a.Latitude)*(b.Longitude-a.Longitude)
+			if point.Longitude < crossing {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// PitDetector finds pit stops from the car being in the pit lane. The time
+// the car is stopped with the engine off is totalled over the visit, so a
+// driver change and a refuel with a roll forward in between are one stop.
+type PitDetector struct {
+	pitLane GPSPolygon
+
+	mu        sync.Mutex
+	inPitLane bool
+	// first frame on the other side of the pit lane boundary, zero if the
+	// car is on the same side as before
+	boundary time.Time
+	current  *telemetry.PitStop
+	lastTime time.Time
+	// whether the car was stopped with the engine off in the last frame,
+	// which holds until the next frame
+	lastStopped bool
+
+	stops []telemetry.PitStop
+	count int
+}
+
+func NewPitDetector(pitLane GPSPolygon) *PitDetector {
+	return &PitDetector{pitLane: pitLane}
+}
+
+// Update adds a frame received at the given time, with speed in mph, while
+// the car has completed lapCount laps. It returns the stop when the car
+// enters or leaves the pit lane.
+func (d *PitDetector) Update(t telemetry.Telemetry, lapCount int, at time.Time) *telemetry.PitStop {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.current != nil && d.lastStopped && !d.lastTime.IsZero() {
+		d.current.Stopped += telemetry.JSONDuration(at.Sub(d.lastTime))
+	}
+	d.lastTime = at
+	d.lastStopped = t.Speed < pitStoppedSpeed && t.RPM < pitEngineOffRPM
+
+	pos := GPSPoint{t.Latitude, t.Longitude}
+	if pos.Latitude == 0 && pos.Longitude == 0 {
+		// no GPS fix, assume the car is where it was
+		return nil
+	}
+	if d.pitLane.Contains(pos) == d.inPitLane {
+		d.boundary = time.Time{}
+		return nil
+	}
+	if d.boundary.IsZero() {
+		d.boundary = at
+	}
+	if at.Sub(d.boundary) < pitLaneDebounce {
+		return nil
+	}
+
+	d.inPitLane = !d.inPitLane
+	changed := d.boundary
+	d.boundary = time.Time{}
+	if d.inPitLane {
+		d.count++
+		d.current = &telemetry.PitStop{Number: d.count, Lap: lapCount, Entry: changed}
+		stop := *d.current
+		return &stop
+	}
+
+	stop := *d.current
+	d.current = nil
+	stop.Exit = &changed
+	stop.PitLaneTime = telemetry.JSONDuration(changed.Sub(stop.Entry))
+	d.stops = append(d.stops, stop)
+	if len(d.stops) > maxPitStops {
+		d.stops = d.stops[len(d.stops)-maxPitStops:]
+	}
+	return &stop
+}
+
+// Stops returns the completed pit stops, followed by the one in progress
+func (d *PitDetector) Stops() []telemetry.PitStop {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stops := append([]telemetry.PitStop(nil), d.stops...)
+	if d.current != nil {
+		stops = append(stops, *d.current)
+	}
+	return stops
+}
+
+// logs a pit stop that has finished and adds it to the session
+func (car *Car) recordPitStop(stop telemetry.PitStop) {
+	if stop.Stopped == 0 {
+		log.Println("car", car.ID, "drove through the pit lane in", time.Duration(stop.PitLaneTime))
+	} else {
+		log.Println("car", car.ID, "pit stop", stop.Number, "stopped for", time.Duration(stop.Stopped),
+			"in the pit lane for", time.Duration(stop.PitLaneTime))
+	}
+	// stops found in a replay are already in the replayed session
+	if recorder != nil && !replaying {
+		recorder.Record(SourceServer, car.ID, stop)
+	}
+}
+
+// HTTP request handler listing a car's pit stops
+//
+//	GET /pits/{car}
+func PitsServer(w http.ResponseWriter, req *http.Request) {
+	car, ok := requestCar(req)
+	if !ok || car.pits == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	b, err := json.Marshal(car.pits.Stops())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
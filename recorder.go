@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionExt = ".jsonl"
+
+// a gap in received frames longer than this starts a new session
+const sessionIdleTimeout = 30 * time.Minute
+
+// how often buffered records are written to disk
+const recorderFlushInterval = time.Second
+
+// used in session file names, sorts in time order
+const sessionNameLayout = "2006-01-02T15-04-05"
+
+// the transport a frame was received over
+const (
+	SourceUDP        = "udp"
+	SourceWebSocket  = "websocket"
+	SourceTimingFeed = "timing"
+	// events the server detected from the received frames
+	SourceServer = "server"
+)
+
+// A single received frame, or an event detected from them or entered by the
+// crew, as written to the session log, one JSON object per line. Only one
+// of Telemetry, Timing, PitStop or DriverChange is set.
+type Record struct {
+	Time      time.Time
+	Source    string
+	Car       string               `json:",omitempty"`
+	Telemetry *telemetry.Telemetry `json:",omitempty"`
+	Timing    *telemetry.Timing    `json:",omitempty"`
+	PitStop   *telemetry.PitStop   `json:",omitempty"`
+
+	DriverChange *telemetry.DriverChange `json:",omitempty"`
+}
+
+// Recorder appends every decoded frame to a log file in sessionDir. A new
+// file is started for each race session.
+type Recorder struct {
+	dir     string
+	records chan Record
+	rotate  chan struct{}
+	// closed once the recorder has stopped writing
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// held to send on records so it isn't closed while frames are still
+	// arriving from the uplink, timing feed and mergers
+	mu     sync.RWMutex
+	closed bool
+
+	file     *os.File
+	writer   *bufio.Writer
+	lastTime time.Time
+}
+
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create session directory")
+	}
+	return &Recorder{
+		dir: dir,
+		// frames are dropped rather than holding up the uplink if the
+		// disk can't keep up
+		records: make(chan Record, config.RecorderBufferSize),
+		rotate:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (r *Recorder) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(r.done)
+		defer r.closeSession()
+
+		ticker := time.NewTicker(recorderFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case rec, ok := <-r.records:
+				if !ok {
+					return
+				}
+				if err := r.write(rec); err != nil {
+					log.Println("unable to record frame:", err)
+				}
+			case <-r.rotate:
+				r.closeSession()
+			case <-ticker.C:
+				if r.writer != nil {
+					if err := r.writer.Flush(); err != nil {
+						log.Println("unable to flush session log:", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Record queues a decoded telemetry.Telemetry or telemetry.Timing, a
+// detected telemetry.PitStop or a telemetry.DriverChange, to be written to
+// the current session
+func (r *Recorder) Record(source string, car string, msg interface{}) {
+	rec := Record{Time: time.Now(), Source: source, Car: car}
+	switch m := msg.(type) {
+	case telemetry.Telemetry:
+		rec.Telemetry = &m
+	case telemetry.Timing:
+		rec.Timing = &m
+	case telemetry.PitStop:
+		rec.PitStop = &m
+	case telemetry.DriverChange:
+		rec.DriverChange = &m
+	default:
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.records <- rec:
+	default:
+		log.Println("recorder queue full, dropping frame")
+	}
+}
+
+// NewSession closes the current session so the next frame starts a new one
+func (r *Recorder) NewSession() {
+	select {
+	case r.rotate <- struct{}{}:
+	case <-r.done:
+	}
+}
+
+// Close writes the queued records and stops recording, frames recorded
+// afterwards are dropped
+func (r *Recorder) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.records)
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *Recorder) write(rec Record) error {
+	if r.file != nil && rec.Time.Sub(r.lastTime) > sessionIdleTimeout {
+		r.closeSession()
+	}
+	if r.file == nil {
+		if err := r.openSession(rec.Time); err != nil {
+			return err
+		}
+	}
+	r.lastTime = rec.Time
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "cannot json encode record")
+	}
+	b = append(b, '\n')
+	_, err = r.writer.Write(b)
+	return err
+}
+
+// opens the session file for a frame received at t. The most recent session
+// is carried on if it was written to recently, so restarting the server
+// mid-race doesn't split the session.
+func (r *Recorder) openSession(t time.Time) error {
+	name := filepath.Join(r.dir, t.Format(sessionNameLayout)+sessionExt)
+
+	if r.lastTime.IsZero() {
+		session, ok, err := CurrentSession(r.dir, t)
+		if err != nil {
+			return err
+		}
+		if ok {
+			name = session.Path
+		}
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open session log")
+	}
+	log.Println("recording session to", name)
+	r.file = f
+	r.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (r *Recorder) closeSession() {
+	if r.file == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		log.Println("unable to flush session log:", err)
+	}
+	r.file.Close()
+	r.file = nil
+	r.writer = nil
+}
+
+// CurrentSession returns the latest session if it was written to recently
+// enough that a record at t carries it on, e.g. after a restart
+func CurrentSession(dir string, t time.Time) (Session, bool, error) {
+	sessions, err := ListSessions(dir)
+	if err != nil || len(sessions) == 0 {
+		return Session{}, false, err
+	}
+	latest := sessions[len(sessions)-1]
+	return latest, t.Sub(latest.Modified) <= sessionIdleTimeout, nil
+}
+
+// A recorded session log
+type Session struct {
+	ID       string
+	Path     string `json:"-"`
+	Modified time.Time
+	Size     int64
+}
+
+// ListSessions returns the session logs in dir, oldest first
+func ListSessions(dir string) ([]Session, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read session directory")
+	}
+
+	var sessions []Session
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), sessionExt) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:       strings.TrimSuffix(info.Name(), sessionExt),
+			Path:     filepath.Join(dir, info.Name()),
+			Modified: info.ModTime(),
+			Size:     info.Size(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// HTTP request handler to start a new recording session, e.g. at the start
+// of a race
+func NewSessionHandler(w http.ResponseWriter, req *http.Request) {
+	recorder.NewSession()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReadSession reads every record from a session log. A truncated final line,
+// e.g. from the server being killed mid-write, is skipped.
+func ReadSession(path string) ([]Record, error) {
+	var records []Record
+	err := ScanSession(path, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// returned by a ScanSession callback to stop reading early
+var errStopScan = errors.New("stop scanning session")
+
+// ScanSession calls fn with each record in a session log in turn, without
+// holding the whole log in memory. Bad lines are skipped as in ReadSession.
+func ScanSession(path string, fn func(rec Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open session log")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Println("skipping bad record at", path, "line", line, err)
+			continue
+		}
+		if err := fn(rec); err == errStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "unable to read session log")
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// set when telemetry is being replayed rather than received, so events
+// detected from it aren't recorded a second time
+var replaying bool
+
+// Replayer plays a recorded session back through Car.Publish with the
+// original timing between frames, so dashboards can be driven by real race
+// data.
+type Replayer struct {
+	mu      sync.Mutex
+	session string
+	records []Record
+	next    int
+	playing bool
+	speed   float64
+	loop    bool
+
+	// offset into the session at anchor, advances at speed while playing
+	position time.Duration
+	anchor   time.Time
+
+	// signals the playback goroutine that the state has changed
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Playback state as reported by the HTTP API
+type ReplayStatus struct {
+	Session  string
+	Playing  bool
+	Speed    float64
+	Loop     bool
+	Position JSONSeconds
+	Duration JSONSeconds
+	Frame    int
+	Frames   int
+}
+
+// durations are reported by the replay API in seconds
+type JSONSeconds time.Duration
+
+func (s JSONSeconds) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(time.Duration(s).Seconds(), 'f', 3, 64)), nil
+}
+
+func NewReplayer(path string) (*Replayer, error) {
+	r := &Replayer{
+		speed: 1,
+		wake:  make(chan struct{}, 1),
+	}
+	if err := r.Load(path); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load replaces the session being played, rewinding to the start
+func (r *Replayer) Load(path string) error {
+	records, err := ReadSession(path)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("session %s has no frames", path)
+	}
+
+	r.mu.Lock()
+	r.session = path
+	r.records = records
+	r.seek(0)
+	r.mu.Unlock()
+	r.notify()
+
+	log.Println("loaded", len(records), "frames for replay from", path)
+	return nil
+}
+
+func (r *Replayer) Start() {
+	r.mu.Lock()
+	r.playing = true
+	r.anchor = time.Now()
+	r.mu.Unlock()
+
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			rec, wait, ok := r.due()
+			if ok {
+				var msg interface{}
+				if rec.Telemetry != nil {
+					msg = *rec.Telemetry
+				} else if rec.Timing != nil {
+					msg = *rec.Timing
+				} else if rec.DriverChange == nil {
+					// detected events are found again from the frames
+					continue
+				}
+				car, err := GetCar(rec.Car)
+				if err == nil && rec.DriverChange != nil {
+					err = car.changeDriver(rec.DriverChange.Driver, time.Now())
+				} else if err == nil {
+					err = car.Publish(msg)
+				}
+				if err != nil {
+					log.Println("unable to publish replayed frame:", err)
+				}
+				continue
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			var timerChannel <-chan time.Time
+			if wait >= 0 {
+				timer.Reset(wait)
+				timerChannel = timer.C
+			}
+
+			select {
+			case <-r.stop:
+				return
+			case <-r.wake:
+			case <-timerChannel:
+			}
+		}
+	}()
+}
+
+func (r *Replayer) Close() {
+	if r.stop != nil {
+		close(r.stop)
+		r.wg.Wait()
+		r.stop = nil
+	}
+}
+
+// due returns the next record if it is time to send it. Otherwise it
+// returns how long to wait before checking again, negative to wait
+// until woken.
+func (r *Replayer) due() (Record, time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(r.records) {
+		if !r.loop || !r.playing {
+			if r.playing {
+				r.position = r.offset(len(r.records) - 1)
+				r.playing = false
+			}
+			return Record{}, -1, false
+		}
+		r.seek(0)
+	}
+	if !r.playing {
+		return Record{}, -1, false
+	}
+
+	rec := r.records[r.next]
+	wait := r.offset(r.next) - r.current()
+	if wait > 0 {
+		return Record{}, time.Duration(float64(wait) / r.speed), false
+	}
+	r.next++
+	return rec, 0, true
+}
+
+// offset of record i from the start of the session
+func (r *Replayer) offset(i int) time.Duration {
+	return r.records[i].Time.Sub(r.records[0].Time)
+}
+
+// current playback position, must be called with mu held
+func (r *Replayer) current() time.Duration {
+	if !r.playing {
+		return r.position
+	}
+	return r.position + time.Duration(float64(time.Since(r.anchor))*r.speed)
+}
+
+// moves playback to position, must be called with mu held
+func (r *Replayer) seek(position time.Duration) {
+	if position < 0 {
+		position = 0
+	}
+	r.position = position
+	r.anchor = time.Now()
+	r.next = 0
+	for r.next < len(r.records) && r.offset(r.next) < position {
+		r.next++
+	}
+}
+
+func (r *Replayer) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Replayer) Play() {
+	r.mu.Lock()
+	if !r.playing {
+		if r.next >= len(r.records) {
+			r.seek(0)
+		}
+		r.playing = true
+		r.anchor = time.Now()
+	}
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *Replayer) Pause() {
+	r.mu.Lock()
+	r.position = r.current()
+	r.playing = false
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *Replayer) Seek(position time.Duration) {
+	r.mu.Lock()
+	r.seek(position)
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *Replayer) SetSpeed(speed float64) error {
+	if speed <= 0 {
+		return fmt.Errorf("speed must be greater than zero")
+	}
+	r.mu.Lock()
+	r.position = r.current()
+	r.anchor = time.Now()
+	r.speed = speed
+	r.mu.Unlock()
+	r.notify()
+	return nil
+}
+
+func (r *Replayer) SetLoop(loop bool) {
+	r.mu.Lock()
+	r.loop = loop
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *Replayer) Status() ReplayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ReplayStatus{
+		Session:  r.session,
+		Playing:  r.playing,
+		Speed:    r.speed,
+		Loop:     r.loop,
+		Position: JSONSeconds(r.current()),
+		Duration: JSONSeconds(r.offset(len(r.records) - 1)),
+		Frame:    r.next,
+		Frames:   len(r.records),
+	}
+}
+
+// RegisterHandlers adds the replay control API to the router:
+//
+//	GET  /replay                       playback status
+//	POST /replay/play
+//	POST /replay/pause
+//	POST /replay/seek?position=90.5    seconds from the start of the session
+//	POST /replay/speed?speed=4
+//	POST /replay/loop?loop=true
+//	POST /replay/load?session=<id>     session from the session directory
+//
+// Every request responds with the playback status.
+func (r *Replayer) RegisterHandlers(router *mux.Router) {
+	router.HandleFunc("/replay", r.replayHandler(func(req *http.Request) error {
+		return nil
+	})).Methods("GET")
+	router.HandleFunc("/replay/play", r.replayHandler(func(req *http.Request) error {
+		r.Play()
+		return nil
+	})).Methods("POST")
+	router.HandleFunc("/replay/pause", r.replayHandler(func(req *http.Request) error {
+		r.Pause()
+		return nil
+	})).Methods("POST")
+	router.HandleFunc("/replay/seek", r.replayHandler(func(req *http.Request) error {
+		seconds, err := strconv.ParseFloat(req.FormValue("position"), 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid position")
+		}
+		r.Seek(time.Duration(seconds * float64(time.Second)))
+		return nil
+	})).Methods("POST")
+	router.HandleFunc("/replay/speed", r.replayHandler(func(req *http.Request) error {
+		speed, err := strconv.ParseFloat(req.FormValue("speed"), 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid speed")
+		}
+		return r.SetSpeed(speed)
+	})).Methods("POST")
+	router.HandleFunc("/replay/loop", r.replayHandler(func(req *http.Request) error {
+		loop, err := strconv.ParseBool(req.FormValue("loop"))
+		if err != nil {
+			return errors.Wrap(err, "invalid loop")
+		}
+		r.SetLoop(loop)
+		return nil
+	})).Methods("POST")
+	router.HandleFunc("/replay/load", r.replayHandler(func(req *http.Request) error {
+		session := req.FormValue("session")
+		if session == "" || filepath.Base(session) != session {
+			return fmt.Errorf("invalid session %q", session)
+		}
+		return r.Load(filepath.Join(config.SessionDir, session+sessionExt))
+	})).Methods("POST")
+}
+
+// wraps a replay control so that it responds with the playback status
+func (r *Replayer) replayHandler(control func(req *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := control(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := json.Marshal(r.Status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/gorilla/mux"
 	"html/template"
 	"net/http"
+	"path/filepath"
 )
 
 type NavItem struct {
@@ -40,6 +41,11 @@ var CarouselItems = []CarouselItem{
 	{"/static/photos/car13.jpg", "Reborn", "Additional stickers were a must."},
 }
 
+// the path of a template in the configured directory
+func templatePath(name string) string {
+	return filepath.Join(config.TemplateDir, name)
+}
+
 func getCurrentPage(req *http.Request) *NavItem {
 	for _, page := range NavItems {
 		if req.URL.Path == page.Path {
@@ -56,6 +62,7 @@ func RegisterSiteHandlers(r *mux.Router) {
 	r.HandleFunc("/about", AboutHandler)
 	r.HandleFunc("/dashboard", TelemetryHandler)
 	r.HandleFunc("/dashboard2", Telemetry2Handler)
+	r.HandleFunc("/calibrate", CalibrateHandler)
 }
 
 func TelemetryHandler(w http.ResponseWriter, req *http.Request) {
@@ -64,7 +71,7 @@ func TelemetryHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	body, err := template.ParseFiles("templates/telemetry.html")
+	body, err := template.ParseFiles(templatePath("telemetry.html"))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -87,7 +94,30 @@ func Telemetry2Handler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	body, err := template.ParseFiles("templates/telemetry2.html")
+	body, err := template.ParseFiles(templatePath("telemetry2.html"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if err := body.Execute(w, ""); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if err := WriteFooter(w, req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func CalibrateHandler(w http.ResponseWriter, req *http.Request) {
+	if err := WriteHeader(w, req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	body, err := template.ParseFiles(templatePath("calibrate.html"))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -110,7 +140,7 @@ func HomeHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	body, err := template.ParseFiles("templates/home.html")
+	body, err := template.ParseFiles(templatePath("home.html"))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -139,7 +169,7 @@ func AboutHandler(w http.ResponseWriter, req *http.Request) {
 		&CarouselItems,
 	}
 
-	body, err := template.ParseFiles("templates/about.html")
+	body, err := template.ParseFiles(templatePath("about.html"))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -157,7 +187,7 @@ func AboutHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func WriteHeader(w http.ResponseWriter, req *http.Request) error {
-	header, err := template.ParseFiles("templates/header.html", "templates/nav.html")
+	header, err := template.ParseFiles(templatePath("header.html"), templatePath("nav.html"))
 	if err != nil {
 		return err
 	}
@@ -175,7 +205,7 @@ func WriteHeader(w http.ResponseWriter, req *http.Request) error {
 }
 
 func WriteFooter(w http.ResponseWriter, req *http.Request) error {
-	footer, err := template.ParseFiles("templates/footer.html")
+	footer, err := template.ParseFiles(templatePath("footer.html"))
 	if err != nil {
 		return err
 	}
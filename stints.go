@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the time left before a driver must get out that alert rules can
+// use as a Field
+const alertStintMinutesRemaining = "StintMinutesRemaining"
+
+// StintRules are the race's limits on driving time, zero is no limit
+type StintRules struct {
+	MaxStintMinutes float64 `json:",omitempty"`
+	// total over the race for each driver
+	MaxDriverMinutes float64 `json:",omitempty"`
+}
+
+// used when no rules file can be found
+var defaultStintRules = StintRules{MaxStintMinutes: 120}
+
+// limits the stints are checked against
+var stintRules = defaultStintRules
+
+// LoadStintRules reads the driving time limits
+func LoadStintRules(path string) (StintRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return StintRules{}, errors.Wrapf(err, "unable to open stint rules")
+	}
+	defer f.Close()
+
+	var rules StintRules
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return StintRules{}, errors.Wrapf(err, "unable to parse stint rules %s", path)
+	}
+	if rules.MaxStintMinutes < 0 || rules.MaxDriverMinutes < 0 {
+		return StintRules{}, fmt.Errorf("stint limits in %s must not be negative", path)
+	}
+	return rules, nil
+}
+
+// Stint is a spell in the car by a single driver. Laps are those completed
+// during the stint, so the lap the driver changed on counts for the new
+// driver.
+type Stint struct {
+	Driver string
+	Start  time.Time
+	// nil for the driver in the car
+	End  *time.Time               `json:",omitempty"`
+	Laps []telemetry.JSONDuration `json:",omitempty"`
+	// only laps with a fuel measurement are counted in FuelUsed
+	FuelUsed float64 `json:",omitempty"`
+	fuelLaps int
+}
+
+func (s Stint) duration(now time.Time) time.Duration {
+	if s.End != nil {
+		return s.End.Sub(s.Start)
+	}
+	return now.Sub(s.Start)
+}
+
+// DriverStats are a driver's totals over the race
+type DriverStats struct {
+	Driver      string
+	Stints      int
+	DrivingTime telemetry.JSONDuration
+	Laps        int
+	BestLap     telemetry.JSONDuration `json:",omitempty"`
+	AverageLap  telemetry.JSONDuration `json:",omitempty"`
+	FuelUsed    float64                `json:",omitempty"`
+	FuelPerLap  float64                `json:",omitempty"`
+}
+
+// StintTracker records who is driving the car, crediting laps and fuel to
+// them and working out how long they have left to drive
+type StintTracker struct {
+	mu       sync.Mutex
+	stints   []Stint
+	lapCount int
+
+	bestLap       telemetry.JSONDuration
+	bestLapDriver string
+}
+
+func NewStintTracker() *StintTracker {
+	return &StintTracker{}
+}
+
+// ChangeDriver ends the current stint and starts one for driver
+func (s *StintTracker) ChangeDriver(driver string, at time.Time) error {
+	driver = strings.TrimSpace(driver)
+	if driver == "" {
+		return fmt.Errorf("a driver name is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.stints); n > 0 {
+		current := &s.stints[n-1]
+		if current.Driver == driver {
+			return fmt.Errorf("%s is already driving", driver)
+		}
+		current.End = &at
+	}
+	s.stints = append(s.stints, Stint{Driver: driver, Start: at})
+	return nil
+}
+
+// Driver returns the driver in the car, empty if no driver has been set
+func (s *StintTracker) Driver() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stints) == 0 {
+		return ""
+	}
+	return s.stints[len(s.stints)-1].Driver
+}
+
+// Timing credits a completed lap, and the fuel used on it if it was
+// measured, to the driver in the car and fills in the driver names
+func (s *StintTracker) Timing(t *telemetry.Timing, fuelUsed float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stints) == 0 {
+		return
+	}
+	current := &s.stints[len(s.stints)-1]
+
+	// a jump in the count is the timing feed catching up, only the last
+	// lap time is known
+	if t.LapCount > s.lapCount && t.LastLap > 0 {
+		current.Laps = append(current.Laps, t.LastLap)
+		if fuelUsed > 0 {
+			current.FuelUsed += fuelUsed
+			current.fuelLaps++
+		}
+		if s.bestLap == 0 || t.LastLap < s.bestLap {
+			s.bestLap = t.LastLap
+			s.bestLapDriver = current.Driver
+		}
+	}
+	if t.LapCount > s.lapCount {
+		s.lapCount = t.LapCount
+	}
+
+	t.DriverName = current.Driver
+	// the best lap may have been set before drivers were being tracked
+	if s.bestLap != 0 && t.BestLap == s.bestLap {
+		t.BestLapDriver = s.bestLapDriver
+	}
+}
+
+// minutes until the driver in the car reaches a limit, false if there is
+// no driver or no limit
+func (s *StintTracker) minutesRemaining(rules StintRules, now time.Time) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stints) == 0 {
+		return 0, false
+	}
+	current := s.stints[len(s.stints)-1]
+
+	remaining := math.Inf(1)
+	if rules.MaxStintMinutes > 0 {
+		remaining = rules.MaxStintMinutes - current.duration(now).Minutes()
+	}
+	if rules.MaxDriverMinutes > 0 {
+		var driven time.Duration
+		for _, stint := range s.stints {
+			if stint.Driver == current.Driver {
+				driven += stint.duration(now)
+			}
+		}
+		remaining = math.Min(remaining, rules.MaxDriverMinutes-driven.Minutes())
+	}
+	return remaining, !math.IsInf(remaining, 1)
+}
+
+// Stints returns every stint of the race
+func (s *StintTracker) Stints() []Stint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Stint(nil), s.stints...)
+}
+
+// Drivers returns each driver's totals, in the order they first drove
+func (s *StintTracker) Drivers(now time.Time) []DriverStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var drivers []DriverStats
+	index := make(map[string]int)
+	fuelLaps := make(map[string]int)
+	lapTotal := make(map[string]time.Duration)
+	for _, stint := range s.stints {
+		i, ok := index[stint.Driver]
+		if !ok {
+			i = len(drivers)
+			index[stint.Driver] = i
+			drivers = append(drivers, DriverStats{Driver: stint.Driver})
+		}
+		d := &drivers[i]
+		d.Stints++
+		d.DrivingTime += telemetry.JSONDuration(stint.duration(now))
+		d.Laps += len(stint.Laps)
+		d.FuelUsed += stint.FuelUsed
+		fuelLaps[stint.Driver] += stint.fuelLaps
+		for _, lap := range stint.Laps {
+			lapTotal[stint.Driver] += time.Duration(lap)
+			if d.BestLap == 0 || lap < d.BestLap {
+				d.BestLap = lap
+			}
+		}
+	}
+
+	for i := range drivers {
+		d := &drivers[i]
+		if d.Laps > 0 {
+			d.AverageLap = telemetry.JSONDuration(lapTotal[d.Driver] / time.Duration(d.Laps))
+		}
+		if n := fuelLaps[d.Driver]; n > 0 {
+			d.FuelPerLap = d.FuelUsed / float64(n)
+		}
+	}
+	return drivers
+}
+
+// changes the car's driver, adding the change to the session, and
+// publishes the new driver name to clients
+func (car *Car) changeDriver(driver string, at time.Time) error {
+	if err := car.stints.ChangeDriver(driver, at); err != nil {
+		return err
+	}
+	driver = car.stints.Driver()
+	log.Println("car", car.ID, "driver changed to", driver)
+	// changes in a replay are already in the replayed session
+	if recorder != nil && !replaying {
+		recorder.Record(SourceServer, car.ID, telemetry.DriverChange{Driver: driver})
+	}
+
+	// the name is sent to clients with the timing
+	car.lock.RLock()
+	timing, haveTiming := car.lastTiming, car.haveTiming
+	car.lock.RUnlock()
+	if !haveTiming {
+		return nil
+	}
+	return car.publish(timing)
+}
+
+// HTTP request handler for the car's stints and driver statistics:
+//
+//	GET /stints/{car}
+//
+// or registering a driver change:
+//
+//	POST /stints/{car}/driver?driver=name
+func StintsServer(w http.ResponseWriter, req *http.Request) {
+	car, ok := requestCar(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method == "POST" {
+		if err := car.changeDriver(req.FormValue("driver"), time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	data := struct {
+		Driver           string   `json:",omitempty"`
+		MinutesRemaining *float64 `json:",omitempty"`
+		Rules            StintRules
+		Stints           []Stint
+		Drivers          []DriverStats
+	}{
+		Driver:  car.stints.Driver(),
+		Rules:   stintRules,
+		Stints:  car.stints.Stints(),
+		Drivers: car.stints.Drivers(now),
+	}
+	if remaining, ok := car.stints.minutesRemaining(stintRules, now); ok {
+		data.MinutesRemaining = &remaining
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
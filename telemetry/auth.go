@@ -0,0 +1,36 @@
+package telemetry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// number of bytes of HMAC-SHA256 appended to each signed UDP datagram,
+// truncated to keep the overhead on the uplink down
+const SignatureSize = 16
+
+// Sign returns the frame with its HMAC appended, for sending over UDP
+func Sign(frame []byte, key []byte) []byte {
+	signed := make([]byte, len(frame), len(frame)+SignatureSize)
+	copy(signed, frame)
+	return append(signed, signature(frame, key)...)
+}
+
+// Verify checks the HMAC on a signed datagram and returns the frame
+func Verify(datagram []byte, key []byte) ([]byte, error) {
+	if len(datagram) < SignatureSize {
+		return nil, fmt.Errorf("datagram too short to be signed")
+	}
+	frame := datagram[:len(datagram)-SignatureSize]
+	if !hmac.Equal(datagram[len(frame):], signature(frame, key)) {
+		return nil, fmt.Errorf("datagram signature does not match")
+	}
+	return frame, nil
+}
+
+func signature(frame []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame)
+	return mac.Sum(nil)[:SignatureSize]
+}
@@ -0,0 +1,56 @@
+package telemetry
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOR frames are the Header type byte followed by a CBOR map keyed by the
+// small integers given in the Telemetry and Timing struct tags. Zero values
+// are left out, and floats are sent at the shortest precision that doesn't
+// lose information, keeping frames small on the cellular uplink. Any CBOR
+// library can produce them, e.g. for Telemetry:
+//
+//	0x04 {1: 3300.0, 3: 20.0, 10: 35.488151852742455, ...}
+var cborEncMode cbor.EncMode
+
+func init() {
+	var err error
+	cborEncMode, err = cbor.EncOptions{
+		ShortestFloat: cbor.ShortestFloat16,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (t Telemetry) EncodeCBOR() ([]byte, error) {
+	return encodeCBOR(TypeCBORTelemetry, t)
+}
+
+func (t Timing) EncodeCBOR() ([]byte, error) {
+	return encodeCBOR(TypeCBORTiming, t)
+}
+
+func encodeCBOR(msgType uint8, v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{msgType})
+	err := cborEncMode.NewEncoder(buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func decodeCBOR(msgType uint8, data []byte) (interface{}, error) {
+	if msgType == TypeCBORTiming {
+		var tempTiming Timing
+		if err := cbor.Unmarshal(data, &tempTiming); err != nil {
+			return nil, fmt.Errorf("invalid CBOR timing frame: %v", err)
+		}
+		return tempTiming, nil
+	}
+
+	var tempTelemetry Telemetry
+	if err := cbor.Unmarshal(data, &tempTelemetry); err != nil {
+		return nil, fmt.Errorf("invalid CBOR telemetry frame: %v", err)
+	}
+	return tempTelemetry, nil
+}
@@ -0,0 +1,119 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"sync"
+)
+
+// Delta frames cut the size of telemetry on the cellular uplink by only
+// sending the fields that differ from the last keyframe. Keyframes carry
+// every field and are sent periodically:
+//
+//	keyframe  Header{TypeKeyTelemetry}   version, key id, all fields
+//	delta     Header{TypeDeltaTelemetry} version, key id, changed fields
+//
+// Fields use the tagged layout from wire.go. Deltas are relative to the
+// keyframe rather than the previous delta so that losing a frame only
+// loses that frame. A delta is only applied if its key id matches the last
+// keyframe received, otherwise it is rejected until the next keyframe
+// arrives.
+
+// default number of frames between keyframes
+const DefaultKeyframeInterval = 50
+
+// DeltaEncoder produces keyframes and delta frames for the car side of the
+// uplink
+type DeltaEncoder struct {
+	// frames between keyframes, DefaultKeyframeInterval if not positive
+	KeyframeInterval int
+
+	count int
+	keyID uint8
+	key   Telemetry
+}
+
+func NewDeltaEncoder() *DeltaEncoder {
+	return &DeltaEncoder{KeyframeInterval: DefaultKeyframeInterval}
+}
+
+func (e *DeltaEncoder) Encode(t Telemetry) ([]byte, error) {
+	interval := e.KeyframeInterval
+	if interval <= 0 {
+		interval = DefaultKeyframeInterval
+	}
+	buf := new(bytes.Buffer)
+	if e.count%interval == 0 {
+		e.keyID++
+		e.key = t
+		if err := binary.Write(buf, binary.LittleEndian, Header{TypeKeyTelemetry}); err != nil {
+			return buf.Bytes(), err
+		}
+		buf.Write([]byte{TaggedVersion, e.keyID})
+		writeTaggedFields(buf, t, nil)
+	} else {
+		if err := binary.Write(buf, binary.LittleEndian, Header{TypeDeltaTelemetry}); err != nil {
+			return buf.Bytes(), err
+		}
+		buf.Write([]byte{TaggedVersion, e.keyID})
+		current, key := reflect.ValueOf(t), reflect.ValueOf(e.key)
+		writeTaggedFields(buf, t, func(name string) bool {
+			return current.FieldByName(name).Interface() != key.FieldByName(name).Interface()
+		})
+	}
+	e.count++
+	return buf.Bytes(), nil
+}
+
+// Decoder decodes any frame accepted by Decode, keeping the keyframe state
+// needed to reconstruct full Telemetry from delta frames. It is safe for
+// concurrent use.
+type Decoder struct {
+	mu      sync.Mutex
+	haveKey bool
+	keyID   uint8
+	key     Telemetry
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+func (d *Decoder) Decode(data []byte) (interface{}, error) {
+	if len(data) < 1 || (data[0] != TypeKeyTelemetry && data[0] != TypeDeltaTelemetry) {
+		return Decode(data)
+	}
+
+	body := data[1:]
+	if err := checkTaggedVersion(body); err != nil {
+		return nil, err
+	}
+	if len(body) < 2 {
+		return nil, errors.Wrap(ErrTruncated, "delta telemetry frame has no key id")
+	}
+	keyID := body[1]
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if data[0] == TypeKeyTelemetry {
+		var t Telemetry
+		if err := readTaggedFields(body[2:], &t); err != nil {
+			return nil, err
+		}
+		d.key, d.keyID, d.haveKey = t, keyID, true
+		return t, nil
+	}
+
+	if !d.haveKey || keyID != d.keyID {
+		return nil, fmt.Errorf("delta frame for keyframe %d but last keyframe was %d, waiting for next keyframe", keyID, d.keyID)
+	}
+	t := d.key
+	if err := readTaggedFields(body[2:], &t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
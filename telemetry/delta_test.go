@@ -0,0 +1,88 @@
+package telemetry
+
+import (
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	encoder := &DeltaEncoder{KeyframeInterval: 3}
+	decoder := NewDecoder()
+
+	frames := []Telemetry{
+		{RPM: 5000, Speed: 80, CoolantTemp: 95, Latitude: 38.16, Longitude: -122.45},
+		{RPM: 5200, Speed: 82, CoolantTemp: 95, Latitude: 38.16, Longitude: -122.45},
+		{RPM: 5200, Speed: 0, CoolantTemp: 96, Latitude: 38.17, Longitude: -122.45},
+		{RPM: 3000, Speed: 40, CoolantTemp: 96, Latitude: 38.17, Longitude: -122.46},
+		{RPM: 3100, Speed: 40, CoolantTemp: 97, Latitude: 38.17, Longitude: -122.46},
+	}
+	for i, want := range frames {
+		b, err := encoder.Encode(want)
+		if err != nil {
+			t.Fatalf("frame %d: encode: %v", i, err)
+		}
+		wantType := byte(TypeDeltaTelemetry)
+		if i%3 == 0 {
+			wantType = TypeKeyTelemetry
+		}
+		if b[0] != wantType {
+			t.Errorf("frame %d: type %d, want %d", i, b[0], wantType)
+		}
+
+		got, err := decoder.Decode(b)
+		if err != nil {
+			t.Fatalf("frame %d: decode: %v", i, err)
+		}
+		if got.(Telemetry) != want {
+			t.Errorf("frame %d: decoded %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestDeltaZeroValueEncoder(t *testing.T) {
+	var encoder DeltaEncoder
+	for i := 0; i < DefaultKeyframeInterval+1; i++ {
+		b, err := encoder.Encode(Telemetry{RPM: float32(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		isKey := b[0] == TypeKeyTelemetry
+		if wantKey := i%DefaultKeyframeInterval == 0; isKey != wantKey {
+			t.Errorf("frame %d: keyframe %v, want %v", i, isKey, wantKey)
+		}
+	}
+}
+
+func TestDeltaKeyMismatch(t *testing.T) {
+	encoder := NewDeltaEncoder()
+	key, _ := encoder.Encode(Telemetry{RPM: 1000})
+	delta, _ := encoder.Encode(Telemetry{RPM: 2000})
+
+	// a delta arriving before any keyframe is rejected
+	decoder := NewDecoder()
+	if _, err := decoder.Decode(delta); err == nil {
+		t.Error("delta without a keyframe was accepted")
+	}
+
+	// as is a delta for a keyframe that was lost
+	other := NewDeltaEncoder()
+	other.keyID = 5
+	otherKey, _ := other.Encode(Telemetry{RPM: 1})
+	if _, err := decoder.Decode(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decoder.Decode(delta); err == nil {
+		t.Error("delta for a different keyframe was accepted")
+	}
+
+	// until its own keyframe arrives
+	if _, err := decoder.Decode(key); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decoder.Decode(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.(Telemetry).RPM != 2000 {
+		t.Errorf("RPM %v, want 2000", got.(Telemetry).RPM)
+	}
+}
@@ -0,0 +1,121 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// An envelope carries metadata about a frame without changing the frame
+// itself, so any frame type can be wrapped:
+//
+//	Header{TypeEnvelope}, version uint8, length uint8, fields, frame
+//
+// The fields use the same tag, length, value layout as tagged telemetry,
+// with the tags below. Frames that aren't wrapped in an envelope are
+// treated as having an empty Envelope. Unknown tags are skipped, so new
+// fields can be added without changing the version.
+const EnvelopeVersion = 1
+
+const (
+	envelopeTagCarID = 1
+	// uint32, little endian
+	envelopeTagSequence = 2
+	// int64 nanoseconds since the Unix epoch, little endian
+	envelopeTagTime = 3
+)
+
+// longest car id that fits in an envelope field
+const MaxCarIDLength = 255
+
+type Envelope struct {
+	// identifies which car sent the frame when more than one car is
+	// uplinking to the same server
+	CarID string
+
+	// counts up by one for each frame the car sends, zero if not sent. Used
+	// to measure how many frames are lost on the way.
+	Sequence uint32
+	// the car's clock when it sent the frame, zero if not sent
+	Time time.Time
+}
+
+// Wrap returns the frame inside an envelope
+func Wrap(env Envelope, frame []byte) ([]byte, error) {
+	fields := new(bytes.Buffer)
+	if env.CarID != "" {
+		if len(env.CarID) > MaxCarIDLength {
+			return nil, fmt.Errorf("car id %q is too long", env.CarID)
+		}
+		fields.WriteByte(envelopeTagCarID)
+		fields.WriteByte(uint8(len(env.CarID)))
+		fields.WriteString(env.CarID)
+	}
+	if env.Sequence != 0 {
+		fields.Write([]byte{envelopeTagSequence, 4})
+		binary.Write(fields, binary.LittleEndian, env.Sequence)
+	}
+	if !env.Time.IsZero() {
+		fields.Write([]byte{envelopeTagTime, 8})
+		binary.Write(fields, binary.LittleEndian, env.Time.UnixNano())
+	}
+	if fields.Len() > 255 {
+		return nil, fmt.Errorf("envelope fields too long")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{TypeEnvelope, EnvelopeVersion, uint8(fields.Len())})
+	buf.Write(fields.Bytes())
+	buf.Write(frame)
+	return buf.Bytes(), nil
+}
+
+// Unwrap splits an envelope from the frame it carries. Data that isn't in
+// an envelope is returned as is.
+func Unwrap(data []byte) (Envelope, []byte, error) {
+	var env Envelope
+	if len(data) < 1 || data[0] != TypeEnvelope {
+		return env, data, nil
+	}
+	if len(data) < 3 {
+		return env, nil, fmt.Errorf("envelope truncated")
+	}
+	if data[1] != EnvelopeVersion {
+		return env, nil, fmt.Errorf("unsupported envelope version %d, expected %d", data[1], EnvelopeVersion)
+	}
+	end := 3 + int(data[2])
+	if end > len(data) {
+		return env, nil, fmt.Errorf("envelope truncated")
+	}
+
+	fields := data[3:end]
+	for i := 0; i < len(fields); {
+		if i+2 > len(fields) {
+			return env, nil, fmt.Errorf("envelope field truncated at byte %d", i)
+		}
+		tag, length := fields[i], int(fields[i+1])
+		i += 2
+		if i+length > len(fields) {
+			return env, nil, fmt.Errorf("envelope field %d truncated", tag)
+		}
+		value := fields[i : i+length]
+		i += length
+
+		switch tag {
+		case envelopeTagCarID:
+			env.CarID = string(value)
+		case envelopeTagSequence:
+			if length != 4 {
+				return env, nil, fmt.Errorf("envelope sequence is %d bytes, expected 4", length)
+			}
+			env.Sequence = binary.LittleEndian.Uint32(value)
+		case envelopeTagTime:
+			if length != 8 {
+				return env, nil, fmt.Errorf("envelope time is %d bytes, expected 8", length)
+			}
+			env.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(value)))
+		}
+	}
+	return env, data[end:], nil
+}
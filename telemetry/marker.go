@@ -0,0 +1,13 @@
+package telemetry
+
+// A marker frame is sent by the pit crew at a moment that can also be seen
+// on the video stream, such as the car crossing the line, and is used to
+// calibrate the video delay. It carries no data, the server timestamps it
+// when it arrives:
+//
+//	Header{TypeMarker}
+type Marker struct{}
+
+func (m Marker) Encode() ([]byte, error) {
+	return []byte{TypeMarker}, nil
+}
@@ -16,29 +16,43 @@ type Header struct {
 }
 
 const (
+	// fixed layout Telemetry frame sent by older car units
 	TypeTelemetry = 1
 	TypeTiming    = 2
+	// self-describing Telemetry frame, see wire.go
+	TypeTaggedTelemetry = 3
+	// compact frames for non-Go car software, see cbor.go
+	TypeCBORTelemetry = 4
+	TypeCBORTiming    = 5
+	// keyframe and change-only Telemetry frames, see delta.go
+	TypeKeyTelemetry   = 6
+	TypeDeltaTelemetry = 7
+	// metadata wrapped around another frame, see envelope.go
+	TypeEnvelope = 8
+	// video delay calibration marker, see marker.go
+	TypeMarker = 9
 )
 
+// CBOR keys match the tags used in tagged frames, see wire.go
 type Telemetry struct {
-	RPM         float32
-	OilPressure float32
-	Speed       float32
+	RPM         float32 `cbor:"1,keyasint,omitempty"`
+	OilPressure float32 `cbor:"2,keyasint,omitempty"`
+	Speed       float32 `cbor:"3,keyasint,omitempty"`
 
-	FuelRemaining float32
-	FuelLevel     uint8
+	FuelRemaining float32 `cbor:"4,keyasint,omitempty"`
+	FuelLevel     uint8   `cbor:"5,keyasint,omitempty"`
 
-	OilTemp        float32
-	CoolantTemp    float32
-	AirIntakeTemp  float32
-	BatteryVoltage float32
+	OilTemp        float32 `cbor:"6,keyasint,omitempty"`
+	CoolantTemp    float32 `cbor:"7,keyasint,omitempty"`
+	AirIntakeTemp  float32 `cbor:"8,keyasint,omitempty"`
+	BatteryVoltage float32 `cbor:"9,keyasint,omitempty"`
 
-	Latitude      float64
-	Longitude     float64
-	Altitude      float32
-	Track         float32
-	GPSSpeed      float32
-	GasPedalAngle uint8
+	Latitude      float64 `cbor:"10,keyasint,omitempty"`
+	Longitude     float64 `cbor:"11,keyasint,omitempty"`
+	Altitude      float32 `cbor:"12,keyasint,omitempty"`
+	Track         float32 `cbor:"13,keyasint,omitempty"`
+	GPSSpeed      float32 `cbor:"14,keyasint,omitempty"`
+	GasPedalAngle uint8   `cbor:"15,keyasint,omitempty"`
 }
 
 type TelemetryWithStatus struct {
@@ -47,20 +61,33 @@ type TelemetryWithStatus struct {
 	ErrorFields   []string `json:",omitempty"`
 }
 
+// durations are sent as integer nanoseconds in CBOR frames
 type Timing struct {
-	BestLap       JSONDuration
-	BestLapDriver string
-	LastLap       JSONDuration
-	LapCount      int
-	DriverName    string
+	BestLap       JSONDuration `cbor:"1,keyasint,omitempty"`
+	BestLapDriver string       `cbor:"2,keyasint,omitempty"`
+	LastLap       JSONDuration `cbor:"3,keyasint,omitempty"`
+	LapCount      int          `cbor:"4,keyasint,omitempty"`
+	DriverName    string       `cbor:"5,keyasint,omitempty"`
 
-	TeamAheadName     string
-	TeamAheadLapCount int
-	TeamAheadLastLap  JSONDuration
-	TeamAheadSplit    JSONDuration
+	TeamAheadName     string       `cbor:"6,keyasint,omitempty"`
+	TeamAheadLapCount int          `cbor:"7,keyasint,omitempty"`
+	TeamAheadLastLap  JSONDuration `cbor:"8,keyasint,omitempty"`
+	TeamAheadSplit    JSONDuration `cbor:"9,keyasint,omitempty"`
 }
 
 func (t Telemetry) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, Header{TypeTaggedTelemetry})
+	if err != nil {
+		return buf.Bytes(), err
+	}
+	t.encodeTagged(buf)
+	return buf.Bytes(), nil
+}
+
+// EncodeLegacy encodes the fixed layout frame understood by servers that
+// predate tagged telemetry
+func (t Telemetry) EncodeLegacy() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.LittleEndian, Header{TypeTelemetry})
 	if err != nil {
@@ -90,14 +117,22 @@ func Decode(data []byte) (interface{}, error) {
 	}
 
 	if header.Type == TypeTelemetry {
-		var tempTelemetry Telemetry
-		err := binary.Read(reader, binary.LittleEndian, &tempTelemetry)
+		tempTelemetry, err := decodeLegacy(data[1:])
+		return tempTelemetry, err
+	} else if header.Type == TypeTaggedTelemetry {
+		tempTelemetry, err := decodeTagged(data[1:])
 		return tempTelemetry, err
+	} else if header.Type == TypeCBORTelemetry || header.Type == TypeCBORTiming {
+		return decodeCBOR(header.Type, data[1:])
 	} else if header.Type == TypeTiming {
 		var tempTiming Timing
 		dec := gob.NewDecoder(reader)
 		err := dec.Decode(&tempTiming)
 		return tempTiming, err
+	} else if header.Type == TypeKeyTelemetry || header.Type == TypeDeltaTelemetry {
+		return nil, fmt.Errorf("delta telemetry frames need a Decoder")
+	} else if header.Type == TypeMarker {
+		return Marker{}, nil
 	} else {
 		return nil, fmt.Errorf("Unknown message type (%d)", header.Type)
 	}
@@ -114,6 +149,151 @@ func (d JSONDuration) MarshalJSON() ([]byte, error) {
 	return []byte(stamp), nil
 }
 
+// parses the "mm:ss.ss" format written by MarshalJSON
+func (d *JSONDuration) UnmarshalJSON(b []byte) error {
+	var stamp string
+	if err := json.Unmarshal(b, &stamp); err != nil {
+		return err
+	}
+	var minutes int
+	var seconds float64
+	if _, err := fmt.Sscanf(stamp, "%d:%f", &minutes, &seconds); err != nil {
+		return fmt.Errorf("invalid duration %q", stamp)
+	}
+	*d = JSONDuration(time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)))
+	return nil
+}
+
+// Split time for one sector of a lap, sent when the car crosses the line at
+// the end of the sector
+type SectorTiming struct {
+	Lap int
+	// numbered from 1
+	Sector int
+	Time   JSONDuration
+	// best time for the sector, including this one
+	Best JSONDuration
+	// seconds slower, or faster if negative, than the previous best
+	Delta float64
+	// the sectors of this lap so far
+	Splits []JSONDuration
+	// sum of the best sectors, once every sector has been timed
+	TheoreticalBest JSONDuration `json:",omitempty"`
+}
+
+func (t SectorTiming) JSONEncode() ([]byte, error) {
+	data := struct {
+		Type string
+		Data SectorTiming
+	}{
+		"sector",
+		t,
+	}
+	return json.Marshal(data)
+}
+
+// A visit to the pit lane, sent when the car enters the pit lane and again
+// when it leaves
+type PitStop struct {
+	Number int
+	// the lap the car came in on
+	Lap   int `json:",omitempty"`
+	Entry time.Time
+	// nil while the car is in the pit lane
+	Exit *time.Time `json:",omitempty"`
+	// time spent stationary with the engine off, zero for a drive through
+	Stopped     JSONDuration `json:",omitempty"`
+	PitLaneTime JSONDuration `json:",omitempty"`
+}
+
+func (p PitStop) JSONEncode() ([]byte, error) {
+	data := struct {
+		Type string
+		Data PitStop
+	}{
+		"pit",
+		p,
+	}
+	return json.Marshal(data)
+}
+
+// A change of the driver in the car, recorded so that the stints can be
+// rebuilt from the session
+type DriverChange struct {
+	Driver string
+}
+
+// Health of the uplink from a car, sent to dashboards periodically. The car
+// is Stale when no frame has arrived over any source for a while, so the
+// values shown are out of date.
+type LinkStatus struct {
+	Stale bool
+	// nil if nothing has been received
+	LastReceived *time.Time `json:",omitempty"`
+	// the source the latest frame used arrived over, the freshest when the
+	// car sends over more than one
+	Primary string `json:",omitempty"`
+	Sources []LinkSourceStatus
+}
+
+// Health of one of the transports frames are received over. Loss, jitter
+// and latency need the car to send a sequence number and timestamp in the
+// frame envelope.
+type LinkSourceStatus struct {
+	Source       string
+	Stale        bool
+	LastReceived time.Time
+	Received     uint64
+	// frames that arrived over this source before any copy over another and
+	// were decoded, the rest were duplicates or undecodable
+	Used uint64
+	// frames that arrived but couldn't be decoded, e.g. from firmware using
+	// a different layout
+	Undecodable uint64 `json:",omitempty"`
+	Lost        uint64
+	// fraction of the recent frames that were lost
+	LossRate float64
+	// in milliseconds
+	Jitter  float64 `json:",omitempty"`
+	Latency float64 `json:",omitempty"`
+}
+
+func (s LinkStatus) JSONEncode() ([]byte, error) {
+	data := struct {
+		Type string
+		Data LinkStatus
+	}{
+		"link",
+		s,
+	}
+	return json.Marshal(data)
+}
+
+// Predicted fuel use, fuel is in the same units as FuelRemaining
+type FuelPrediction struct {
+	Remaining float64
+	PerLap    float64 `json:",omitempty"`
+	PerMinute float64 `json:",omitempty"`
+
+	LapsRemaining float64      `json:",omitempty"`
+	TimeRemaining JSONDuration `json:",omitempty"`
+
+	// lap numbers between which the car should pit for fuel
+	PitWindowOpen  int `json:",omitempty"`
+	PitWindowClose int `json:",omitempty"`
+}
+
+func (p FuelPrediction) JSONEncode() ([]byte, error) {
+	data := struct {
+		Type string
+		Data FuelPrediction
+	}{
+		"fuel",
+		p,
+	}
+	return json.Marshal(data)
+}
+
 func (t Timing) JSONEncode() ([]byte, error) {
 	data := struct {
 		Type string
@@ -140,5 +320,9 @@ func (t TelemetryWithStatus) JSONEncode() ([]byte, error) {
 func MaxTelemetrySize() int {
 	var hdr Header
 	var t Telemetry
-	return int(unsafe.Sizeof(hdr) + unsafe.Sizeof(t))
-}
\ No newline at end of file
+	size := int(unsafe.Sizeof(hdr) + unsafe.Sizeof(t))
+	if tagged := maxTaggedSize(); tagged > size {
+		return tagged
+	}
+	return size
+}
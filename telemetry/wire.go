@@ -0,0 +1,176 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+	"reflect"
+)
+
+// reasons a frame can't be decoded, found with errors.Cause
+var (
+	ErrUnknownVersion = errors.New("unknown telemetry version")
+	ErrLayoutMismatch = errors.New("telemetry layout mismatch")
+	ErrTruncated      = errors.New("telemetry frame truncated")
+)
+
+// Tagged telemetry frames are self-describing so that car units running
+// older or newer firmware than the server can still be decoded. After the
+// Header and a protocol version byte, each field is written as
+//
+//	tag    uint8   identifies the field, see telemetryTags
+//	length uint8   size of the value in bytes
+//	value          little endian
+//
+// Fields that are missing from a frame are left as zero, fields with tags
+// the server doesn't know about are skipped.
+const TaggedVersion = 1
+
+// wire tags for the Telemetry fields. Tags must never be renumbered or
+// reused, new fields get the next unused tag.
+var telemetryTags = []struct {
+	Tag  uint8
+	Name string
+}{
+	{1, "RPM"},
+	{2, "OilPressure"},
+	{3, "Speed"},
+	{4, "FuelRemaining"},
+	{5, "FuelLevel"},
+	{6, "OilTemp"},
+	{7, "CoolantTemp"},
+	{8, "AirIntakeTemp"},
+	{9, "BatteryVoltage"},
+	{10, "Latitude"},
+	{11, "Longitude"},
+	{12, "Altitude"},
+	{13, "Track"},
+	{14, "GPSSpeed"},
+	{15, "GasPedalAngle"},
+}
+
+func (t Telemetry) encodeTagged(buf *bytes.Buffer) {
+	buf.WriteByte(TaggedVersion)
+	writeTaggedFields(buf, t, nil)
+}
+
+// writes the fields of t for which include returns true, or all of them if
+// include is nil
+func writeTaggedFields(buf *bytes.Buffer, t Telemetry, include func(name string) bool) {
+	v := reflect.ValueOf(t)
+	for _, field := range telemetryTags {
+		if include != nil && !include(field.Name) {
+			continue
+		}
+		value := encodeValue(v.FieldByName(field.Name))
+		buf.WriteByte(field.Tag)
+		buf.WriteByte(uint8(len(value)))
+		buf.Write(value)
+	}
+}
+
+func decodeTagged(data []byte) (Telemetry, error) {
+	var t Telemetry
+	if err := checkTaggedVersion(data); err != nil {
+		return t, err
+	}
+	err := readTaggedFields(data[1:], &t)
+	return t, err
+}
+
+func checkTaggedVersion(data []byte) error {
+	if len(data) < 1 {
+		return errors.Wrap(ErrTruncated, "tagged telemetry frame has no version")
+	}
+	if data[0] != TaggedVersion {
+		return errors.Wrapf(ErrUnknownVersion, "tagged telemetry version %d, expected %d", data[0], TaggedVersion)
+	}
+	return nil
+}
+
+// sets the fields of t that are present in data
+func readTaggedFields(data []byte, t *Telemetry) error {
+	v := reflect.ValueOf(t).Elem()
+	for i := 0; i < len(data); {
+		if i+2 > len(data) {
+			return errors.Wrapf(ErrTruncated, "tagged telemetry frame ends at byte %d", i)
+		}
+		tag, length := data[i], int(data[i+1])
+		i += 2
+		if i+length > len(data) {
+			return errors.Wrapf(ErrTruncated, "tagged telemetry field %d has %d of %d bytes", tag, len(data)-i, length)
+		}
+		value := data[i : i+length]
+		i += length
+
+		name := tagName(tag)
+		if name == "" {
+			// field added by newer firmware
+			continue
+		}
+		f := v.FieldByName(name)
+		if size := int(f.Type().Size()); size != length {
+			return errors.Wrapf(ErrLayoutMismatch, "tagged telemetry field %s is %d bytes, expected %d", name, length, size)
+		}
+		decodeValue(f, value)
+	}
+	return nil
+}
+
+// decodes the original fixed layout frame, which is only valid if its size
+// matches the Telemetry struct exactly
+func decodeLegacy(data []byte) (Telemetry, error) {
+	var t Telemetry
+	if size := binary.Size(t); len(data) != size {
+		return t, errors.Wrapf(ErrLayoutMismatch, "telemetry frame is %d bytes, expected %d; car firmware may be using a different layout", len(data), size)
+	}
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &t)
+	return t, err
+}
+
+func tagName(tag uint8) string {
+	for _, field := range telemetryTags {
+		if field.Tag == tag {
+			return field.Name
+		}
+	}
+	return ""
+}
+
+func encodeValue(f reflect.Value) []byte {
+	b := make([]byte, f.Type().Size())
+	switch f.Kind() {
+	case reflect.Float32:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(f.Float())))
+	case reflect.Float64:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(f.Float()))
+	case reflect.Uint8:
+		b[0] = uint8(f.Uint())
+	default:
+		panic("unsupported telemetry field type " + f.Type().String())
+	}
+	return b
+}
+
+func decodeValue(f reflect.Value, b []byte) {
+	switch f.Kind() {
+	case reflect.Float32:
+		f.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case reflect.Float64:
+		f.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case reflect.Uint8:
+		f.SetUint(uint64(b[0]))
+	}
+}
+
+// largest tagged frame the server will receive
+func maxTaggedSize() int {
+	var t Telemetry
+	size := 2
+	v := reflect.ValueOf(t)
+	for _, field := range telemetryTags {
+		size += 2 + int(v.FieldByName(field.Name).Type().Size())
+	}
+	return size
+}
@@ -1,34 +1,109 @@
 package main
 
 import (
+	"flag"
 	"github.com/gorilla/websocket"
 	"github.com/jd3nn1s/lemonaid/telemetry"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"time"
 )
 
 func main() {
-	u := url.URL{Scheme: "ws", Host: "localhost:80", Path: "/ws/telemetry_in"}
-	log.Printf("connecting to %s", u.String())
+	useCBOR := flag.Bool("cbor", false, "send compact CBOR frames instead of the default encoding")
+	useDelta := flag.Bool("delta", false, "send keyframes and change-only telemetry frames")
+	token := flag.String("token", "", "uplink token for the websocket")
+	udpAddr := flag.String("udp", "", "send over udp to this address instead of the websocket, e.g. localhost:2020")
+	key := flag.String("key", "", "shared key to sign udp datagrams with")
+	carID := flag.String("car", "", "car id to send in the frame envelope when running more than one car")
+	marker := flag.Bool("marker", false, "send a video delay calibration marker and exit")
+	server := flag.String("server", "localhost:80", "address of the server's websocket")
+	useTLS := flag.Bool("tls", false, "connect to the websocket over TLS (wss)")
+	dual := flag.Bool("dual", false, "send every frame over both udp and the websocket, as a car with two modems does")
+	flag.Parse()
+
+	deltaEncoder := telemetry.NewDeltaEncoder()
+
+	var senders []func([]byte) error
+	sendFrame := func(b []byte) error {
+		for _, send := range senders {
+			if err := send(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// the sequence and timestamp let the server measure the link
+	var sequence uint32
+	send := func(b []byte) error {
+		sequence++
+		env := telemetry.Envelope{CarID: *carID, Sequence: sequence, Time: time.Now()}
+		b, err := telemetry.Wrap(env, b)
+		if err != nil {
+			return err
+		}
+		return sendFrame(b)
+	}
+	if *udpAddr != "" {
+		log.Printf("sending to udp %s", *udpAddr)
+		c, err := net.Dial("udp", *udpAddr)
+		if err != nil {
+			log.Fatal("dial:", err)
+		}
+		defer c.Close()
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatal("dial:", err)
+		senders = append(senders, func(b []byte) error {
+			if *key != "" {
+				b = telemetry.Sign(b, []byte(*key))
+			}
+			_, err := c.Write(b)
+			return err
+		})
 	}
-	defer c.Close()
+	if *udpAddr == "" || *dual {
+		u := url.URL{Scheme: "ws", Host: *server, Path: "/ws/telemetry_in"}
+		if *useTLS {
+			u.Scheme = "wss"
+		}
+		log.Printf("connecting to %s", u.String())
 
-	go func() {
-		// we never expect to read anything but just in case...
+		header := http.Header{}
+		if *token != "" {
+			header.Set("Authorization", "Bearer "+*token)
+		}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+		if err != nil {
+			log.Fatal("dial:", err)
+		}
 		defer c.Close()
-		for {
-			_, _, err := c.ReadMessage()
-			if err != nil {
-				log.Println("read:", err)
-				break
+
+		go func() {
+			// we never expect to read anything but just in case...
+			defer c.Close()
+			for {
+				_, _, err := c.ReadMessage()
+				if err != nil {
+					log.Println("read:", err)
+					break
+				}
 			}
+		}()
+
+		senders = append(senders, func(b []byte) error {
+			return c.WriteMessage(websocket.BinaryMessage, b)
+		})
+	}
+
+	if *marker {
+		bytes, _ := telemetry.Marker{}.Encode()
+		if err := send(bytes); err != nil {
+			log.Fatal("Unable to send marker to server", err)
 		}
-	}()
+		log.Println("Sent calibration marker")
+		return
+	}
 
 	t := telemetry.Telemetry{
 		Latitude:  35.488151852742455,
@@ -73,12 +148,20 @@ func main() {
 
 		}
 
-		bytes, err := t.Encode()
+		var bytes []byte
+		var err error
+		if *useCBOR {
+			bytes, err = t.EncodeCBOR()
+		} else if *useDelta {
+			bytes, err = deltaEncoder.Encode(t)
+		} else {
+			bytes, err = t.Encode()
+		}
 		if err != nil {
 			log.Println("Unable to encode telemetry", err)
 			break
 		}
-		err = c.WriteMessage(websocket.BinaryMessage, bytes)
+		err = send(bytes)
 		if err != nil {
 			log.Println("Unable to send bytes to server", err)
 			break
@@ -88,12 +171,16 @@ func main() {
 		if count == 10 {
 			count = 0
 
-			bytes, err = timing.Encode()
+			if *useCBOR {
+				bytes, err = timing.EncodeCBOR()
+			} else {
+				bytes, err = timing.Encode()
+			}
 			if err != nil {
 				log.Println("Unable to encode timing", err)
 				break
 			}
-			err = c.WriteMessage(websocket.BinaryMessage, bytes)
+			err = send(bytes)
 			if err != nil {
 				log.Println("Unable to send bytes to server", err)
 				break
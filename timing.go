@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/jd3nn1s/lemonaid/telemetry"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long to wait before reconnecting to a timing feed that has failed
+const timingReconnectDelay = 5 * time.Second
+
+// A live race timing feed
+type TimingSource interface {
+	// Run connects to the feed and sends timing for our car until the
+	// connection fails or the source is closed
+	Run(timingTelemetry chan<- telemetry.Timing) error
+	Close()
+}
+
+// constructors for the supported timing feed protocols, keyed by name
+var timingSources = map[string]func(addr string, car string) TimingSource{
+	"rmonitor": NewRMonitorSource,
+}
+
+func NewTimingSource(protocol string, addr string, car string) (TimingSource, error) {
+	newSource, ok := timingSources[protocol]
+	if !ok {
+		return nil, fmt.Errorf("unknown timing protocol %q", protocol)
+	}
+	if car == "" {
+		return nil, fmt.Errorf("car number is required for live timing")
+	}
+	return newSource(addr, car), nil
+}
+
+// runs the timing source forever, reconnecting whenever the feed drops
+func startLapTimes(source TimingSource, timingTelemetry chan<- telemetry.Timing) {
+	for {
+		err := source.Run(timingTelemetry)
+		log.Println("timing feed disconnected:", err)
+		time.Sleep(timingReconnectDelay)
+	}
+}
+
+// Client for the Orbits RMonitor scoreboard protocol. The feed is a TCP
+// stream of comma separated records, one per line, covering every car in
+// the race:
+//
+//	$A,"1234BE","12X",52474,"John","Johnson","USA",5   competitor
+//	$COMP,"1234BE","12X",5,"John","Johnson","USA",""   competitor
+//	$G,3,"1234BE",14,"01:12:47.872"                   race position
+//	$J,"1234BE","00:02:03.826","01:42:17.672"          line crossing
+//
+// Competitors are identified by registration number, our car and the car
+// ahead of it are found from their race numbers and positions.
+type RMonitorSource struct {
+	addr string
+	car  string
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	competitors map[string]*competitor
+	// last timing sent, so unchanged timing isn't sent again
+	last telemetry.Timing
+}
+
+type competitor struct {
+	number   string
+	name     string
+	position int
+	laps     int
+	lastLap  time.Duration
+	bestLap  time.Duration
+	// elapsed race time at the end of each lap
+	crossings map[int]time.Duration
+}
+
+func NewRMonitorSource(addr string, car string) TimingSource {
+	return &RMonitorSource{
+		addr: addr,
+		car:  car,
+	}
+}
+
+func (s *RMonitorSource) Run(timingTelemetry chan<- telemetry.Timing) error {
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to timing feed")
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	defer s.Close()
+
+	log.Println("connected to timing feed", s.addr)
+	s.competitors = make(map[string]*competitor)
+	s.last = telemetry.Timing{}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		changed, err := s.parseRecord(line)
+		if err != nil {
+			log.Println("ignoring timing record:", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if timing := s.timing(); timing != s.last {
+			s.last = timing
+			timingTelemetry <- timing
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "unable to read timing feed")
+	}
+	return errors.New("timing feed closed")
+}
+
+func (s *RMonitorSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// updates the race state from a record, returning true if the timing for
+// our car may have changed
+func (s *RMonitorSource) parseRecord(line string) (bool, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	fields, err := reader.Read()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse %q", line)
+	}
+
+	short := func(n int) error {
+		return fmt.Errorf("%s record has %d fields, expected %d", fields[0], len(fields), n)
+	}
+
+	switch fields[0] {
+	case "$A":
+		if len(fields) < 6 {
+			return false, short(6)
+		}
+		c := s.competitor(fields[1])
+		c.number = fields[2]
+		c.name = strings.TrimSpace(fields[4] + " " + fields[5])
+	case "$COMP":
+		if len(fields) < 6 {
+			return false, short(6)
+		}
+		c := s.competitor(fields[1])
+		c.number = fields[2]
+		c.name = strings.TrimSpace(fields[4] + " " + fields[5])
+	case "$G":
+		if len(fields) < 5 {
+			return false, short(5)
+		}
+		position, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid position")
+		}
+		laps, err := strconv.Atoi(fields[3])
+		if err != nil {
+			// cars that haven't started yet have no lap count
+			laps = 0
+		}
+		c := s.competitor(fields[2])
+		c.position = position
+		c.laps = laps
+		if elapsed, err := parseRMonitorTime(fields[4]); err == nil && laps > 0 {
+			c.crossings[laps] = elapsed
+		}
+		return s.isRelevant(c), nil
+	case "$J":
+		if len(fields) < 4 {
+			return false, short(4)
+		}
+		lapTime, err := parseRMonitorTime(fields[2])
+		if err != nil {
+			return false, err
+		}
+		c := s.competitor(fields[1])
+		c.lastLap = lapTime
+		if lapTime > 0 && (c.bestLap == 0 || lapTime < c.bestLap) {
+			c.bestLap = lapTime
+		}
+		return s.isRelevant(c), nil
+	}
+	return false, nil
+}
+
+func (s *RMonitorSource) competitor(regNumber string) *competitor {
+	c, ok := s.competitors[regNumber]
+	if !ok {
+		c = &competitor{crossings: make(map[int]time.Duration)}
+		s.competitors[regNumber] = c
+	}
+	return c
+}
+
+// our car and the one ahead of it on track are the only ones that affect
+// telemetry.Timing
+func (s *RMonitorSource) isRelevant(c *competitor) bool {
+	ours, ahead := s.ourCar()
+	return c == ours || (ahead != nil && c == ahead)
+}
+
+func (s *RMonitorSource) ourCar() (ours *competitor, ahead *competitor) {
+	for _, c := range s.competitors {
+		if c.number == s.car {
+			ours = c
+			break
+		}
+	}
+	if ours == nil || ours.position <= 1 {
+		return ours, nil
+	}
+	for _, c := range s.competitors {
+		if c.position == ours.position-1 {
+			ahead = c
+			break
+		}
+	}
+	return ours, ahead
+}
+
+func (s *RMonitorSource) timing() telemetry.Timing {
+	var timing telemetry.Timing
+	ours, ahead := s.ourCar()
+	if ours == nil {
+		return timing
+	}
+	timing.LapCount = ours.laps
+	timing.LastLap = telemetry.JSONDuration(ours.lastLap)
+	timing.BestLap = telemetry.JSONDuration(ours.bestLap)
+
+	if ahead != nil {
+		timing.TeamAheadName = ahead.name
+		timing.TeamAheadLapCount = ahead.laps
+		timing.TeamAheadLastLap = telemetry.JSONDuration(ahead.lastLap)
+		// gap between the car ahead and us crossing the line at the end
+		// of our latest lap
+		theirs, theirsOK := ahead.crossings[ours.laps]
+		if crossed, ok := ours.crossings[ours.laps]; ok && theirsOK {
+			timing.TeamAheadSplit = telemetry.JSONDuration(crossed - theirs)
+		}
+	}
+	return timing
+}
+
+// parses RMonitor times of the form HH:MM:SS.sss
+func parseRMonitorTime(stamp string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(stamp), ":")
+	var total time.Duration
+	for _, part := range parts[:len(parts)-1] {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", stamp)
+		}
+		total = (total + time.Duration(n)) * 60
+	}
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", stamp)
+	}
+	return total*time.Second + time.Duration(seconds*float64(time.Second)), nil
+}
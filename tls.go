@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the certificate and key are checked for changes
+const certReloadInterval = 5 * time.Second
+
+// CertReloader serves the certificate in a pair of files, loading it again
+// whenever either file changes so a renewed certificate is used without a
+// restart
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	// modification times of the certificate and key last loaded
+	certModTime time.Time
+	keyModTime  time.Time
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewCertReloader loads the certificate and key, both PEM encoded
+func NewCertReloader(certPath string, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reads the certificate and key, replacing the current certificate only if
+// they can be used together
+func (r *CertReloader) Reload() error {
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load certificate %s", r.certPath)
+	}
+
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	log.Println("loaded TLS certificate from", r.certPath)
+	return nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "unable to stat certificate")
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "unable to stat key")
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// starts watching the certificate and key, reloading them whenever either
+// is modified
+func (r *CertReloader) Start() {
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(certReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				certModTime, keyModTime, err := r.modTimes()
+				if err != nil || (certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime)) {
+					continue
+				}
+				if err := r.Reload(); err != nil {
+					log.Println("keeping previous TLS certificate:", err)
+					// don't retry until either file changes again, the
+					// certificate and key are often replaced one at a time
+					r.certModTime = certModTime
+					r.keyModTime = keyModTime
+				}
+			}
+		}
+	}()
+}
+
+func (r *CertReloader) Close() {
+	if r.stop != nil {
+		close(r.stop)
+		r.wg.Wait()
+		r.stop = nil
+	}
+}
+
+// HTTP request handler redirecting to the same page over HTTPS. The car
+// may not be able to follow a redirect, so its uplink is refused instead,
+// unless config.HTTPUplink accepts it over HTTP for a car that can't use
+// TLS.
+func RedirectToHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ws/telemetry_in" {
+			if config.HTTPUplink {
+				next.ServeHTTP(w, req)
+			} else {
+				http.Error(w, "the uplink must use HTTPS", http.StatusForbidden)
+			}
+			return
+		}
+
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			// an IPv6 address
+			host = "[" + host + "]"
+		}
+		if _, port, err := net.SplitHostPort(config.HTTPSAddr); err == nil && port != "443" && port != "" {
+			host += ":" + port
+		}
+
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, req, u.String(), http.StatusPermanentRedirect)
+	})
+}
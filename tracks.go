@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+)
+
+// Track defines the lines used to time laps and sectors. The sector lines
+// are in the order they are crossed after the start/finish line, a track
+// with n sector lines is split into n+1 sectors. Pit stops are only detected
+// on tracks with a PitLane.
+//
+// The track database ships empty as only surveyed lines should be used, a
+// line that misses the track silently stops laps being timed. Survey each
+// line, e.g. by walking it with a GPS or from the car's own recorded
+// session, and note the source in the Description.
+type Track struct {
+	Name        string
+	Description string `json:",omitempty"`
+	StartFinish GPSLine
+	Sectors     []GPSLine  `json:",omitempty"`
+	PitLane     GPSPolygon `json:",omitempty"`
+}
+
+// the track laps are timed on, nil when laps aren't being detected
+var currentTrack *Track
+
+// LoadTracks reads the track database
+func LoadTracks(path string) (map[string]Track, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open track database")
+	}
+	defer f.Close()
+
+	var tracks []Track
+	if err := json.NewDecoder(f).Decode(&tracks); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse track database %s", path)
+	}
+
+	byName := make(map[string]Track, len(tracks))
+	for _, track := range tracks {
+		if track.Name == "" {
+			return nil, fmt.Errorf("track without a name in %s", path)
+		}
+		byName[track.Name] = track
+	}
+	return byName, nil
+}
+
+// HTTP request handler returning the track laps are timed on
+func TrackServer(w http.ResponseWriter, req *http.Request) {
+	if currentTrack == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	b, err := json.Marshal(currentTrack)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
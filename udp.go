@@ -1,26 +1,27 @@
 package main
 
 import (
-	"net"
 	"github.com/pkg/errors"
-	"sync"
 	"log"
-	"github.com/jd3nn1s/lemonaid/telemetry"
+	"net"
+	"sync"
 )
 
 type UDPIncoming struct {
 	serverCon *net.UDPConn
-	wg sync.WaitGroup
+	wg        sync.WaitGroup
 }
 
-const udpPort = "2020"
+// largest UDP payload, gob encoded timing frames don't fit in a buffer
+// sized for telemetry
+const maxDatagramSize = 65507
 
 func NewUDPIncoming() (*UDPIncoming, error) {
 	return &UDPIncoming{}, nil
 }
 
 func (udp *UDPIncoming) Start() error {
-	serverAddr, err := net.ResolveUDPAddr("udp", ":" + udpPort)
+	serverAddr, err := net.ResolveUDPAddr("udp", config.UDPAddr)
 	if err != nil {
 		return errors.Wrapf(err, "unable to start udp incoming")
 	}
@@ -30,7 +31,8 @@ func (udp *UDPIncoming) Start() error {
 		return errors.Wrapf(err, "unable to start listening on udp port")
 	}
 
-	if err = udp.serverCon.SetReadBuffer(telemetry.MaxTelemetrySize() * 2); err != nil {
+	// room for a couple of the largest datagrams while one is processed
+	if err = udp.serverCon.SetReadBuffer(maxDatagramSize * 2); err != nil {
 		return errors.Wrapf(err, "unable to set udp read buffer size")
 	}
 
@@ -38,14 +40,18 @@ func (udp *UDPIncoming) Start() error {
 	go func() {
 		defer udp.wg.Done()
 
-		buf := make([]byte, telemetry.MaxTelemetrySize() * 2)
+		buf := make([]byte, maxDatagramSize)
 		for {
-			_, _, err := udp.serverCon.ReadFromUDP(buf)
+			n, _, err := udp.serverCon.ReadFromUDP(buf)
 			if err != nil {
 				log.Println("error when reading udp socket", err)
 				return
 			}
-			if err := ProcessMsg(buf); err != nil {
+			frame, ok := uplinkAuth.VerifyDatagram(buf[:n])
+			if !ok {
+				continue
+			}
+			if err := ProcessMsg(frame, SourceUDP); err != nil {
 				log.Println("unable to process udp message:", err)
 			}
 		}
@@ -60,4 +66,4 @@ func (udp *UDPIncoming) Close() {
 		udp.wg.Wait()
 		udp.serverCon = nil
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// longest delay a client can ask for, history is kept for this long
+const maxVideoDelay = 10 * time.Minute
+
+// delay used by videosync clients that haven't asked for their own
+var videoDelay = &delaySetting{
+	delay:   int64(time.Second * 63),
+	changed: make(chan struct{}),
+}
+
+type delaySetting struct {
+	delay int64
+
+	mu sync.Mutex
+	// closed and replaced whenever the delay changes
+	changed chan struct{}
+}
+
+func (d *delaySetting) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.delay))
+}
+
+func (d *delaySetting) Set(delay time.Duration) {
+	atomic.StoreInt64(&d.delay, int64(delay))
+	d.mu.Lock()
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+func (d *delaySetting) Changed() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+// Video synchronized message
+type SyncedMessage struct {
+	QueuedTime time.Time
+	Message    []byte
+
+	// breaks ties between messages queued at the same time
+	seq uint64
+}
+
+func (m SyncedMessage) before(o SyncedMessage) bool {
+	if m.QueuedTime.Equal(o.QueuedTime) {
+		return m.seq < o.seq
+	}
+	return m.QueuedTime.Before(o.QueuedTime)
+}
+
+// SyncedHistory keeps a car's recent messages in the order they were
+// queued. Each videosync client plays the history back at its own delay.
+type SyncedHistory struct {
+	mu       sync.Mutex
+	messages []SyncedMessage
+	nextSeq  uint64
+	// closed and replaced whenever a message is added
+	changed chan struct{}
+	closed  chan struct{}
+	clients map[*SyncedClient]bool
+
+	// messages dropped for slow clients, including ones since disconnected
+	dropped uint64
+}
+
+func NewSyncedHistory() *SyncedHistory {
+	return &SyncedHistory{
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+		clients: make(map[*SyncedClient]bool),
+	}
+}
+
+// Add stores a message, dropping messages older than any client could want
+func (h *SyncedHistory) Add(queuedTime time.Time, message []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// start at one so there is always room for a cursor just before a message
+	h.nextSeq++
+	msg := SyncedMessage{QueuedTime: queuedTime, Message: message, seq: h.nextSeq}
+
+	// messages almost always arrive in order, so search from the end
+	i := len(h.messages)
+	for i > 0 && msg.before(h.messages[i-1]) {
+		i--
+	}
+	h.messages = append(h.messages, SyncedMessage{})
+	copy(h.messages[i+1:], h.messages[i:])
+	h.messages[i] = msg
+
+	expired := sort.Search(len(h.messages), func(i int) bool {
+		return h.messages[i].QueuedTime.After(time.Now().Add(-maxVideoDelay))
+	})
+	h.messages = h.messages[expired:]
+
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Len returns how many messages are held for clients to play back
+func (h *SyncedHistory) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.messages)
+}
+
+// Dropped returns how many messages have been dropped for slow clients
+func (h *SyncedHistory) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Close disconnects every client
+func (h *SyncedHistory) Close() {
+	close(h.closed)
+}
+
+// first message after cursor, along with a channel that is closed when
+// more messages arrive
+func (h *SyncedHistory) next(cursor SyncedMessage) (SyncedMessage, bool, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.Search(len(h.messages), func(i int) bool {
+		return cursor.before(h.messages[i])
+	})
+	if i == len(h.messages) {
+		return SyncedMessage{}, false, h.changed
+	}
+	return h.messages[i], true, h.changed
+}
+
+// cursor that makes the last message due at the given delay the next one
+// to be sent, so a client is up to date as soon as its delay changes
+func (h *SyncedHistory) cursorFor(delay time.Duration) SyncedMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	due := time.Now().Add(-delay)
+	i := sort.Search(len(h.messages), func(i int) bool {
+		return h.messages[i].QueuedTime.After(due)
+	})
+	if i == 0 {
+		return SyncedMessage{}
+	}
+	last := h.messages[i-1]
+	return SyncedMessage{QueuedTime: last.QueuedTime, seq: last.seq - 1}
+}
+
+// SyncedClient is a videosync websocket client. Like a Hub subscriber, a
+// client that can't keep up has messages dropped and is evicted if it
+// falls too far behind, at which point C is closed.
+type SyncedClient struct {
+	C <-chan []byte
+
+	name      string
+	connected time.Time
+	history   *SyncedHistory
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	mu sync.Mutex
+	// zero to follow videoDelay
+	delay        time.Duration
+	delayChanged chan struct{}
+
+	sent    uint64
+	dropped uint64
+}
+
+// VideoSyncClientStats describes a connected videosync client
+type VideoSyncClientStats struct {
+	Name      string
+	Connected time.Time
+	Sent      uint64
+	Dropped   uint64
+	// the client's own delay in seconds, zero if it follows the default
+	Delay float64
+}
+
+// Subscribe starts playing the history to a new client. delay is the
+// client's own delay, or zero to follow videoDelay.
+func (h *SyncedHistory) Subscribe(name string, delay time.Duration) *SyncedClient {
+	c := make(chan []byte, config.SubscriberBufferSize)
+	client := &SyncedClient{
+		C:            c,
+		name:         name,
+		connected:    time.Now(),
+		history:      h,
+		stop:         make(chan struct{}),
+		delay:        delay,
+		delayChanged: make(chan struct{}, 1),
+	}
+
+	h.mu.Lock()
+	h.clients[client] = true
+	h.mu.Unlock()
+
+	go client.play(c)
+	return client
+}
+
+// Unsubscribe stops sending to the client
+func (h *SyncedHistory) Unsubscribe(client *SyncedClient) {
+	client.stopOnce.Do(func() {
+		close(client.stop)
+	})
+	h.mu.Lock()
+	delete(h.clients, client)
+	h.mu.Unlock()
+}
+
+func (h *SyncedHistory) Clients() []VideoSyncClientStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make([]VideoSyncClientStats, 0, len(h.clients))
+	for client := range h.clients {
+		client.mu.Lock()
+		stats = append(stats, VideoSyncClientStats{
+			Name:      client.name,
+			Connected: client.connected,
+			Sent:      atomic.LoadUint64(&client.sent),
+			Dropped:   atomic.LoadUint64(&client.dropped),
+			Delay:     client.delay.Seconds(),
+		})
+		client.mu.Unlock()
+	}
+	return stats
+}
+
+// SetDelay changes the client's delay, zero to follow videoDelay
+func (client *SyncedClient) SetDelay(delay time.Duration) {
+	client.mu.Lock()
+	client.delay = delay
+	client.mu.Unlock()
+	select {
+	case client.delayChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (client *SyncedClient) Delay() time.Duration {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.delay == 0 {
+		return videoDelay.Get()
+	}
+	return client.delay
+}
+
+// go routine that sends each message to the client once it has been
+// delayed to match the video stream. Messages are sent in order, each at
+// its own time.
+func (client *SyncedClient) play(c chan<- []byte) {
+	defer close(c)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	consecutiveDrops := 0
+	cursor := client.history.cursorFor(client.Delay())
+	for {
+		delay := client.Delay()
+		defaultChanged := videoDelay.Changed()
+
+		msg, ok, added := client.history.next(cursor)
+		var timerChannel <-chan time.Time
+		if ok {
+			wait := msg.QueuedTime.Add(delay).Sub(time.Now())
+			if wait <= 0 {
+				select {
+				case c <- msg.Message:
+					atomic.AddUint64(&client.sent, 1)
+					consecutiveDrops = 0
+				case <-client.stop:
+					return
+				case <-client.history.closed:
+					return
+				default:
+					atomic.AddUint64(&client.dropped, 1)
+					atomic.AddUint64(&client.history.dropped, 1)
+					consecutiveDrops++
+					if consecutiveDrops >= maxConsecutiveDrops {
+						log.Println("Evicting slow videosync client", client.name, "after", consecutiveDrops, "dropped messages")
+						return
+					}
+				}
+				cursor = msg
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			timerChannel = timer.C
+		}
+
+		select {
+		case <-client.stop:
+			return
+		case <-client.history.closed:
+			return
+		case <-timerChannel:
+		case <-added:
+		case <-client.delayChanged:
+			cursor = client.history.cursorFor(client.Delay())
+		case <-defaultChanged:
+			cursor = client.history.cursorFor(client.Delay())
+		}
+	}
+}
+
+// parses a delay in seconds
+func parseVideoDelay(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delay %q", value)
+	}
+	return videoDelaySeconds(seconds)
+}
+
+// checks the delay is one the history can serve
+func videoDelaySeconds(seconds float64) (time.Duration, error) {
+	delay := time.Duration(seconds * float64(time.Second))
+	if delay < 0 || delay > maxVideoDelay {
+		return 0, fmt.Errorf("delay must be between 0 and %v", maxVideoDelay)
+	}
+	return delay, nil
+}
+
+// HTTP request handler to get, or with POST change, the default video
+// delay in seconds:
+//
+//	POST /videosync/delay?delay=45.5
+func VideoDelayServer(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		delay, err := parseVideoDelay(req.FormValue("delay"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		videoDelay.Set(delay)
+	}
+
+	b, err := json.Marshal(struct {
+		Delay float64
+	}{videoDelay.Get().Seconds()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"time"
-	"net/http"
+	"encoding/json"
 	"github.com/gorilla/websocket"
-	"log"
 	"github.com/jd3nn1s/lemonaid/telemetry"
 	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"time"
 )
 
 var upgrader = websocket.Upgrader{
@@ -18,89 +19,52 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func ProcessMsg(msg []byte) error {
-	telemetryMsg, err := telemetry.Decode(msg)
-
+// ProcessMsg takes a frame received from the car, passing it through the
+// car's merger to remove copies sent over more than one source
+func ProcessMsg(msg []byte, source string) error {
+	env, frame, err := telemetry.Unwrap(msg)
 	if err != nil {
-		return errors.Wrap(err, "cannot read bytes from nerdobd2:")
-
+		decodeErrors.WithLabelValues(decodeErrorEnvelope).Inc()
+		return errors.Wrap(err, "cannot read envelope")
 	}
+	car, err := UplinkCar(env.CarID, source)
+	if err != nil {
+		decodeErrors.WithLabelValues(decodeErrorCar).Inc()
+		return err
+	}
+	now := time.Now()
+	car.link.Received(source, env, now)
+	car.merger.Add(env.Sequence, frame, source, now)
+	return nil
+}
 
-	tempTelemetry, ok := telemetryMsg.(telemetry.Telemetry)
-
-	var b []byte
-
-	if ok {
-		tempTelemetry.Speed = float32(int(tempTelemetry.Speed*0.6213712*10)) / 10
-		// add error/warning fields
-		var warnings []string
-		var errs []string
-
-		if tempTelemetry.FuelLevel < 5 {
-			errs = append(errs, []string{"FuelRemaining", "FuelLevel"}...)
-		} else if tempTelemetry.FuelLevel < 20 {
-			warnings = append(warnings, []string{"FuelRemaining", "FuelLevel"}...)
-		}
-
-		if tempTelemetry.CoolantTemp > 110 {
-			errs = append(errs, "CoolantTemp")
-		} else if tempTelemetry.CoolantTemp > 105 {
-			warnings = append(warnings, "CoolantTemp")
-		}
-
-		if tempTelemetry.BatteryVoltage < 11 {
-			errs = append(errs, "BatteryVoltage")
-		} else if tempTelemetry.BatteryVoltage < 12 {
-			warnings = append(warnings, "BatteryVoltage")
-		}
-
-		if tempTelemetry.OilTemp > 260 {
-			errs = append(errs, "OilTemp")
-		} else if tempTelemetry.OilTemp > 250 {
-			warnings = append(warnings, "OilTemp")
-		}
-
-		telemetryWithStatus := telemetry.TelemetryWithStatus{
-			&tempTelemetry,
-			warnings,
-			errs,
-		}
-
-		lock.Lock()
-		lastTelemetry = telemetryWithStatus
-		lock.Unlock()
-
-		b, err = telemetryWithStatus.JSONEncode()
+// decodes and publishes a frame that has been through the merger
+func (car *Car) processFrame(frame []byte, source string) error {
+	telemetryMsg, err := car.decoder.Decode(frame)
 
-		if err != nil {
-			return errors.Wrap(err, "cannot json encode telemetry")
-		}
-	} else {
-		tempTiming, ok := telemetryMsg.(telemetry.Timing)
-		if ok {
-			b, err = tempTiming.JSONEncode()
+	if err != nil {
+		decodeErrors.WithLabelValues(decodeErrorReason(err)).Inc()
+		car.link.Undecodable(source)
+		return errors.Wrap(err, "cannot read bytes from nerdobd2:")
 
-			if err != nil {
-				return errors.Wrap(err, "cannot JSON encode timing")
-			}
-		}
 	}
-	select {
-	case sendChannel <- b:
-	default:
+	if _, ok := telemetryMsg.(telemetry.Marker); ok {
+		calibration.Mark(car.ID)
+		return nil
 	}
+	recorder.Record(source, car.ID, telemetryMsg)
 
-	select {
-	case videoSyncedSendChannel <- SyncedMessage{time.Now(), b}:
-	default:
-		// don't block if we can't send
-	}
-	return nil
+	return car.Publish(telemetryMsg)
 }
 
 // telemetry uplink handler. Decodes binary websocket message and forwards
 // to broadcaster
 func WebSocketIncomingHandler(w http.ResponseWriter, req *http.Request) {
+	if !uplinkAuth.VerifyRequest(req) {
+		http.Error(w, "invalid uplink token", http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -116,7 +80,7 @@ func WebSocketIncomingHandler(w http.ResponseWriter, req *http.Request) {
 			continue
 		}
 
-		if err = ProcessMsg(msg); err != nil {
+		if err = ProcessMsg(msg, SourceWebSocket); err != nil {
 			log.Println("unable to process websocket msg:", err)
 			continue
 		}
@@ -124,12 +88,13 @@ func WebSocketIncomingHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 // websocket clients that will be sent telemetry as it comes in
-func WebSocketOutgoingHandler(w http.ResponseWriter, req *http.Request, c <-chan []byte) {
+func WebSocketOutgoingHandler(w http.ResponseWriter, req *http.Request, car *Car, c <-chan []byte) {
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer conn.Close()
 
 	// read is required for proper websocket operation
 	go func() {
@@ -146,11 +111,9 @@ func WebSocketOutgoingHandler(w http.ResponseWriter, req *http.Request, c <-chan
 		var msg []byte
 		if first {
 			// send last telemetry frame when a new client connects
-			lock.RLock()
-			msg, err = lastTelemetry.JSONEncode()
-			msgTiming, errTiming := lastTimingTelemetry.JSONEncode()
-			lock.RUnlock()
-			if errTiming != nil {
+			var msgTiming []byte
+			msg, msgTiming, err = car.LastMessages()
+			if err == nil && msgTiming != nil {
 				conn.WriteMessage(websocket.TextMessage, msgTiming)
 			}
 
@@ -160,7 +123,11 @@ func WebSocketOutgoingHandler(w http.ResponseWriter, req *http.Request, c <-chan
 				continue
 			}
 		} else {
-			msg = <-c
+			var ok bool
+			if msg, ok = <-c; !ok {
+				// evicted or the server is shutting down
+				return
+			}
 		}
 		err = conn.WriteMessage(websocket.TextMessage, msg)
 		if err != nil {
@@ -170,26 +137,51 @@ func WebSocketOutgoingHandler(w http.ResponseWriter, req *http.Request, c <-chan
 	}
 }
 
-// websocket clients that will be sent telemetry delayed by the amount that the video is buffered by
-func WebSocketVideoSyncOutgoingHandler(w http.ResponseWriter, req *http.Request, c <-chan []byte) {
+// websocket clients that will be sent telemetry delayed by the amount that
+// the video is buffered by. A client can change its delay by sending
+// {"Delay": seconds}, zero to follow the default delay again.
+func WebSocketVideoSyncOutgoingHandler(w http.ResponseWriter, req *http.Request, client *SyncedClient) {
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer conn.Close()
 
 	// read is required for proper websocket operation
 	go func() {
 		for {
-			if _, _, err := conn.NextReader(); err != nil {
+			t, msg, err := conn.ReadMessage()
+			if err != nil {
 				conn.Close()
 				break
 			}
+			if t != websocket.TextMessage {
+				continue
+			}
+
+			var control struct {
+				Delay *float64
+			}
+			if err := json.Unmarshal(msg, &control); err != nil || control.Delay == nil {
+				log.Println("ignoring videosync control message from", req.RemoteAddr)
+				continue
+			}
+			delay, err := videoDelaySeconds(*control.Delay)
+			if err != nil {
+				log.Println("ignoring videosync control message from", req.RemoteAddr, err)
+				continue
+			}
+			client.SetDelay(delay)
 		}
 	}()
 
 	for {
-		msg := <-c
+		msg, ok := <-client.C
+		if !ok {
+			// the server is shutting down or the client was too slow
+			return
+		}
 		err = conn.WriteMessage(websocket.TextMessage, msg)
 		if err != nil {
 			log.Println("Outgoing websocket closed")